@@ -0,0 +1,46 @@
+package cdphttp
+
+import (
+	"math"
+	"time"
+)
+
+// Backoff decides how long to wait before a reconnect attempt
+type Backoff interface {
+	// Next returns the delay before retry number attempt, starting at 0
+	Next(attempt int) time.Duration
+}
+
+// ExponentialBackoff doubles the delay on every attempt, starting at Base
+// and capped at Max. A Max of zero or less means no cap.
+type ExponentialBackoff struct {
+	Base time.Duration
+	Max  time.Duration
+}
+
+// defaultBackoff waits 100ms, 200ms, 400ms, ... up to 5s
+var defaultBackoff Backoff = ExponentialBackoff{Base: 100 * time.Millisecond, Max: 5 * time.Second}
+
+// Next implements Backoff
+func (b ExponentialBackoff) Next(attempt int) time.Duration {
+	limit := b.Max
+	if limit <= 0 {
+		limit = math.MaxInt64
+	}
+	d := min(b.Base, limit)
+	for i := 0; i < attempt && d > 0 && d < limit; i++ {
+		if d > limit/2 {
+			return limit // doubling would pass the cap or overflow
+		}
+		d *= 2
+	}
+	return d
+}
+
+// ConstantBackoff always waits the same delay
+type ConstantBackoff time.Duration
+
+// Next implements Backoff
+func (b ConstantBackoff) Next(int) time.Duration {
+	return time.Duration(b)
+}
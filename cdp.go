@@ -2,55 +2,394 @@ package cdphttp
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/coder/websocket"
 )
 
-// cdpClient is a simple Chrome DevTools Protocol client
+// ResponseMatcher reports whether message, as read from the websocket, is
+// the response to the command with the given id, and if so returns the CDP
+// response object ({"id", "result", "error"}) it carries.
+//
+// It lets clients talk to proxies that wrap responses in an envelope, e.g.
+//
+//	{"type": "cdp", "payload": {"id": 1, "result": {...}}}
+//
+// could be matched with
+//
+//	func(message []byte, id int64) ([]byte, bool) {
+//		var envelope struct {
+//			Payload json.RawMessage `json:"payload"`
+//		}
+//		var inner struct {
+//			ID int64 `json:"id"`
+//		}
+//		if json.Unmarshal(message, &envelope) != nil || json.Unmarshal(envelope.Payload, &inner) != nil {
+//			return nil, false
+//		}
+//		return envelope.Payload, inner.ID == id
+//	}
+type ResponseMatcher func(message []byte, id int64) (response []byte, ok bool)
+
+// cdpClient is a simple Chrome DevTools Protocol client. Commands may be
+// sent concurrently: a single reader goroutine hands each response to the
+// command waiting for its id.
 type cdpClient struct {
 	conn   *websocket.Conn
 	nextID atomic.Int64
+
+	// writeMu serializes writes to conn
+	writeMu sync.Mutex
+
+	// pending holds a channel per command awaiting its response, listeners
+	// the channels receiving the params of events by method. Once the
+	// reader exits, readErr is set and all channels are closed.
+	pendingMu sync.Mutex
+	pending   map[int64]chan json.RawMessage
+	listeners map[string][]chan json.RawMessage
+	readErr   error
+	startRead sync.Once
+	readDone  chan struct{} // closed when the reader exits
+
+	// dead is set once the connection closed abnormally and must be replaced
+	dead atomic.Bool
+
+	// readLimit is the maximum decompressed size of a message
+	readLimit int64
+
+	// commandTimeout bounds each command; zero leaves only the caller's
+	// context deadline
+	commandTimeout time.Duration
+
+	// lenient tolerates non-standard JSON from Chromium forks
+	lenient bool
+
+	// matchResponse, if set, replaces matching responses by top-level id
+	matchResponse ResponseMatcher
+
+	// onUnmatched, if set, is called with responses no command waits for
+	onUnmatched func(id int64, message []byte)
+
+	// adaptiveTimeout, if set, bounds cookie fetches instead of the fixed
+	// command timeout
+	adaptiveTimeout *adaptiveTimeout
+
+	// recorder, if set, receives every command and its response
+	recorder *recorder
+
+	// noPartitionKeys is set once the browser rejected cookie partition
+	// keys, which older browsers don't know or expect as a plain string
+	noPartitionKeys atomic.Bool
+
+	logger *slog.Logger
+}
+
+// discardLogger is the default logger, logging nothing
+var discardLogger = slog.New(slog.DiscardHandler)
+
+// defaultCommandTimeout is how long a command may take by default
+const defaultCommandTimeout = 10 * time.Second
+
+// defaultReadLimit is the maximum size of a CDP message, large enough for
+// big cookie responses
+const defaultReadLimit = 10 * 1024 * 1024
+
+// dialOptions configures how a CDP connection is established
+type dialOptions struct {
+	origin string // Origin header sent with the websocket handshake
+
+	// header is sent with the /json requests and the websocket handshake,
+	// e.g. for authentication. Its values are redacted from errors.
+	header http.Header
+
+	// compression is the permessage-deflate mode; disabled by default
+	compression websocket.CompressionMode
+
+	// dialContext, if set, makes the TCP connections for both the
+	// /json/version fetch and the websocket
+	dialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// httpClient is used for the /json endpoints and the websocket
+	// handshake; nil means debugHTTPClient
+	httpClient *http.Client
+
+	// tlsConfig configures TLS for wss:// endpoints unless httpClient is set
+	tlsConfig *tls.Config
+
+	// netResolver resolves the debug host; nil means net.DefaultResolver
+	netResolver *net.Resolver
+
+	// family selects among the resolved addresses of the debug host
+	family AddressFamily
+
+	// keepHost connects to the debug host by name instead of resolving it
+	// to an IP address first
+	keepHost bool
+
+	// versionRetries is how often a transient failure to fetch
+	// /json/version is retried, versionRetryDelay the pause in between
+	versionRetries    int
+	versionRetryDelay time.Duration
+
+	// readLimit caps the size of a single message in bytes, defaulting to
+	// defaultReadLimit; -1 means no limit. It applies to the decompressed
+	// message, so enabling compression does not let larger responses
+	// through.
+	readLimit int64
+}
+
+// client returns the HTTP client to talk to the debug endpoint with
+func (opts *dialOptions) client() *http.Client {
+	if opts.httpClient != nil {
+		return opts.httpClient
+	}
+	return debugHTTPClient
+}
+
+// debugHTTPClient talks to debug endpoints by default. It has its own
+// transport so that changes to http.DefaultTransport don't affect it, and
+// doesn't use proxies from the environment since the debug endpoint is
+// usually local.
+var debugHTTPClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       90 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+	},
+}
+
+// newRequest creates a GET request to the debug endpoint carrying header
+func (opts *dialOptions) newRequest(ctx context.Context, u *url.URL) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range opts.header {
+		req.Header[key] = values
+	}
+	return req, nil
+}
+
+// get fetches a /json endpoint
+func (opts *dialOptions) get(ctx context.Context, u *url.URL) (*http.Response, error) {
+	req, err := opts.newRequest(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	return opts.client().Do(req)
+}
+
+// transientFailure reports whether a /json request failed in a way that
+// may go away on retry: the connection failed or a proxy in front of
+// Chrome reported it unavailable
+func transientFailure(resp *http.Response, err error) bool {
+	if err != nil {
+		return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// redact replaces the values of header in err's message
+func (opts *dialOptions) redact(err error) error {
+	if err == nil || len(opts.header) == 0 {
+		return err
+	}
+	msg := err.Error()
+	for _, values := range opts.header {
+		for _, v := range values {
+			if v != "" {
+				msg = strings.ReplaceAll(msg, v, "[REDACTED]")
+			}
+		}
+	}
+	if msg == err.Error() {
+		return err
+	}
+	return &redactedError{msg: msg, err: err}
+}
+
+// redactedError is an error whose message had secrets removed
+type redactedError struct {
+	msg string
+	err error
+}
+
+func (e *redactedError) Error() string { return e.msg }
+func (e *redactedError) Unwrap() error { return e.err }
+
+// newDebugHTTPClient returns a client like debugHTTPClient that dials with
+// dialContext, if set, and uses tlsConfig
+func newDebugHTTPClient(dialContext func(ctx context.Context, network, addr string) (net.Conn, error), tlsConfig *tls.Config) *http.Client {
+	transport := debugHTTPClient.Transport.(*http.Transport).Clone()
+	if dialContext != nil {
+		transport.DialContext = dialContext
+	}
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: transport}
+}
+
+// isTLS reports whether a debug URL is served over TLS
+func isTLS(u *url.URL) bool {
+	return u.Scheme == "wss" || u.Scheme == "https"
+}
+
+// resolver returns the resolver to look up the debug host with
+func (opts *dialOptions) resolver() *net.Resolver {
+	if opts.netResolver != nil {
+		return opts.netResolver
+	}
+	return net.DefaultResolver
 }
 
 // createCDPClient connects to Chrome's debugging port
 func createCDPClient(ctx context.Context, debugURL string) (*cdpClient, error) {
+	return dialCDPClient(ctx, debugURL, dialOptions{})
+}
+
+// dialCDPClient connects to Chrome's debugging port using opts
+func dialCDPClient(ctx context.Context, debugURL string, opts dialOptions) (*cdpClient, error) {
 	// Get WebSocket URL from the debug endpoint
-	wsURL, err := getWebSocketURL(ctx, debugURL)
+	wsURL, err := getWebSocketURL(ctx, &opts, debugURL)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get websocket URL: %w", err)
+		return nil, fmt.Errorf("failed to get websocket URL: %w", opts.redact(err))
 	}
 
+	return dialWebSocket(ctx, wsURL, opts)
+}
+
+// dialWebSocket connects to a CDP websocket URL
+func dialWebSocket(ctx context.Context, wsURL string, opts dialOptions) (*cdpClient, error) {
+	header := opts.header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	if opts.origin != "" {
+		header.Set("Origin", opts.origin)
+	}
+
+	defer recordTiming(ctx, time.Now(), func(t *RefreshTimings) *time.Duration { return &t.Dial })
 	conn, _, err := websocket.Dial(ctx, wsURL, &websocket.DialOptions{
-		CompressionMode: websocket.CompressionDisabled,
+		HTTPClient:      opts.client(),
+		HTTPHeader:      header,
+		CompressionMode: opts.compression,
 	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to Chrome: %w", err)
+		return nil, fmt.Errorf("failed to connect to Chrome: %w", opts.redact(err))
 	}
 
-	// Set read limit to 10MB to handle large cookie responses
-	conn.SetReadLimit(10 * 1024 * 1024)
+	// Set read limit to handle large cookie responses
+	readLimit := opts.readLimit
+	if readLimit == 0 {
+		readLimit = defaultReadLimit
+	}
+	conn.SetReadLimit(readLimit)
 
-	return &cdpClient{conn: conn}, nil
+	return &cdpClient{
+		conn:           conn,
+		readLimit:      readLimit,
+		commandTimeout: defaultCommandTimeout,
+		pending:        make(map[int64]chan json.RawMessage),
+		listeners:      make(map[string][]chan json.RawMessage),
+		readDone:       make(chan struct{}),
+		logger:         discardLogger,
+	}, nil
 }
 
-// Close closes the WebSocket connection
+// closeTimeout bounds how long Close waits for the close handshake and the
+// reader goroutine
+const closeTimeout = 5 * time.Second
+
+// Close closes the WebSocket connection, see CloseContext
 func (c *cdpClient) Close() error {
-	return c.conn.Close(websocket.StatusNormalClosure, "")
+	ctx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+	defer cancel()
+	return c.CloseContext(ctx)
+}
+
+// CloseContext closes the WebSocket connection and waits for the reader
+// goroutine to exit. If ctx ends first, the connection is closed without
+// completing the handshake and ctx's error is returned.
+func (c *cdpClient) CloseContext(ctx context.Context) error {
+	// Keep the reader from starting if it hasn't yet
+	c.startRead.Do(func() { close(c.readDone) })
+
+	dead := c.dead.Load()
+	closed := make(chan error, 1)
+	go func() { closed <- c.conn.Close(websocket.StatusNormalClosure, "") }()
+
+	var err error
+	select {
+	case err = <-closed:
+	case <-ctx.Done():
+		c.conn.CloseNow()
+		return ctx.Err()
+	}
+	if dead {
+		// The connection already failed, closing it can't succeed
+		err = nil
+	}
+
+	select {
+	case <-c.readDone:
+		return err
+	case <-ctx.Done():
+		c.conn.CloseNow()
+		return ctx.Err()
+	}
 }
 
 // execute sends a CDP command and returns the response
-func (c *cdpClient) execute(pctx context.Context, method string, params any) (json.RawMessage, error) {
+func (c *cdpClient) execute(ctx context.Context, method string, params any) (json.RawMessage, error) {
+	if c.recorder == nil {
+		return c.send(ctx, method, params)
+	}
+
+	start := time.Now()
+	result, err := c.send(ctx, method, params)
+	c.recorder.record(method, params, result, err, time.Since(start))
+	return result, err
+}
+
+// send writes a CDP command and waits for its response
+func (c *cdpClient) send(pctx context.Context, method string, params any) (json.RawMessage, error) {
+	c.startReader()
+
 	id := c.nextID.Add(1)
 
-	ctx, cancel := context.WithTimeout(pctx, 10*time.Second)
+	timeout := c.commandTimeout
+	adaptive := c.adaptiveTimeout != nil && method == "Storage.getCookies"
+	if adaptive {
+		timeout = c.adaptiveTimeout.timeout()
+	}
+	start := time.Now()
+
+	ctx, cancel := pctx, context.CancelFunc(func() {})
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(pctx, timeout)
+	}
 	defer cancel()
 
 	request := map[string]any{
@@ -60,84 +399,326 @@ func (c *cdpClient) execute(pctx context.Context, method string, params any) (js
 	if params != nil {
 		request["params"] = params
 	}
+	data, err := json.Marshal(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode %s request: %w", method, err)
+	}
+
+	ch := make(chan json.RawMessage, 1)
+	c.pendingMu.Lock()
+	if c.readErr != nil {
+		err := c.readErr
+		c.pendingMu.Unlock()
+		return nil, c.readError(method, err)
+	}
+	c.pending[id] = ch
+	c.pendingMu.Unlock()
+	defer func() {
+		c.pendingMu.Lock()
+		delete(c.pending, id)
+		c.pendingMu.Unlock()
+	}()
 
 	// Send request
-	if err := c.conn.Write(ctx, websocket.MessageText, mustMarshal(request)); err != nil {
+	c.writeMu.Lock()
+	err = c.conn.Write(ctx, websocket.MessageText, data)
+	c.writeMu.Unlock()
+	if err != nil {
+		c.checkClosed(err)
 		return nil, fmt.Errorf("failed to send request: %w", err)
 	}
 
-	// Read response
+	// Wait for the response
+	select {
+	case <-ctx.Done():
+		if adaptive && pctx.Err() == nil {
+			c.adaptiveTimeout.timedOut()
+		}
+		return nil, fmt.Errorf("failed to read response: %w", ctx.Err())
+	case msg, ok := <-ch:
+		if !ok {
+			c.pendingMu.Lock()
+			err := c.readErr
+			c.pendingMu.Unlock()
+			return nil, c.readError(method, err)
+		}
+		data = msg
+	}
+
+	var response struct {
+		Result json.RawMessage `json:"result"`
+		Error  *CDPError       `json:"error"`
+	}
+
+	if err := json.Unmarshal(data, &response); err != nil {
+		return nil, fmt.Errorf("failed to parse CDP response: %w", err)
+	}
+
+	if response.Error != nil {
+		response.Error.Method = method
+		return nil, response.Error
+	}
+
+	if adaptive {
+		c.adaptiveTimeout.observe(time.Since(start))
+	}
+
+	return response.Result, nil
+}
+
+// readError describes why the response to method could not be read
+func (c *cdpClient) readError(method string, err error) error {
+	if errors.Is(err, websocket.ErrMessageTooBig) {
+		return fmt.Errorf("%s response exceeds the read limit of %d bytes (decompressed size): %w", method, c.readLimit, err)
+	}
+	return fmt.Errorf("failed to read response: %w", err)
+}
+
+// startReader starts the reader goroutine. It is started on first use
+// rather than on dial so that it sees the settings applied after dialing.
+func (c *cdpClient) startReader() {
+	c.startRead.Do(func() { go c.readLoop() })
+}
+
+// subscribe returns a channel receiving the params of every event of the
+// given method until unsubscribe is called. The channel is closed if the
+// connection fails. Events are dropped while the channel is full.
+func (c *cdpClient) subscribe(method string) (events <-chan json.RawMessage, unsubscribe func()) {
+	c.startReader()
+
+	ch := make(chan json.RawMessage, 16)
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	if c.readErr != nil {
+		close(ch)
+		return ch, func() {}
+	}
+	c.listeners[method] = append(c.listeners[method], ch)
+
+	return ch, func() {
+		c.pendingMu.Lock()
+		defer c.pendingMu.Unlock()
+		listeners := c.listeners[method]
+		for i, l := range listeners {
+			if l == ch {
+				c.listeners[method] = append(listeners[:i:i], listeners[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// readLoop reads messages until the connection fails, hands responses to
+// the commands waiting for them and events to their listeners. Messages
+// nobody waits for, such as responses to timed out commands, are dropped
+// after being reported to onUnmatched.
+func (c *cdpClient) readLoop() {
+	defer close(c.readDone)
 	for {
-		_, data, err := c.conn.Read(ctx)
+		_, data, err := c.conn.Read(context.Background())
 		if err != nil {
-			return nil, fmt.Errorf("failed to read response: %w", err)
-		}
+			c.checkClosed(err)
+			// The connection is unusable once reading fails, e.g. it is
+			// closed on oversized messages
+			c.dead.Store(true)
 
-		var response struct {
-			ID     int64           `json:"id"`
-			Result json.RawMessage `json:"result"`
-			Error  *struct {
-				Code    int    `json:"code"`
-				Message string `json:"message"`
-			} `json:"error"`
+			c.pendingMu.Lock()
+			c.readErr = err
+			for id, ch := range c.pending {
+				close(ch)
+				delete(c.pending, id)
+			}
+			for method, listeners := range c.listeners {
+				for _, ch := range listeners {
+					close(ch)
+				}
+				delete(c.listeners, method)
+			}
+			c.pendingMu.Unlock()
+			return
 		}
 
-		if err := json.Unmarshal(data, &response); err != nil {
-			return nil, fmt.Errorf("failed to parse CDP response: %w", err)
+		if c.lenient {
+			var replaced int
+			if data, replaced = sanitizeNonFinite(data); replaced > 0 {
+				c.logger.Warn("replaced non-finite numbers in CDP message", "count", replaced)
+			}
 		}
 
-		if response.ID != id {
-			continue // Not our response
+		c.pendingMu.Lock()
+		unmatched := c.dispatch(data)
+		c.pendingMu.Unlock()
+
+		if unmatched != 0 && c.onUnmatched != nil {
+			c.onUnmatched(unmatched, data)
 		}
+	}
+}
 
-		if response.Error != nil {
-			return nil, fmt.Errorf("CDP error %d: %s", response.Error.Code, response.Error.Message)
+// dispatch hands a message to the command or listeners waiting for it. It
+// returns the id of a response no command waits for, or 0. pendingMu must
+// be held.
+func (c *cdpClient) dispatch(data []byte) (unmatched int64) {
+	if c.matchResponse != nil {
+		for id, ch := range c.pending {
+			if inner, ok := c.matchResponse(data, id); ok {
+				ch <- inner
+				delete(c.pending, id)
+				return 0
+			}
 		}
+	}
 
-		return response.Result, nil
+	var message struct {
+		ID     int64           `json:"id"`
+		Method string          `json:"method"`
+		Params json.RawMessage `json:"params"`
+	}
+	if json.Unmarshal(data, &message) != nil {
+		return 0
 	}
+
+	if message.ID != 0 {
+		if ch, ok := c.pending[message.ID]; ok && c.matchResponse == nil {
+			ch <- data
+			delete(c.pending, message.ID)
+			return 0
+		}
+		return message.ID
+	}
+	for _, ch := range c.listeners[message.Method] {
+		select {
+		case ch <- message.Params:
+		default: // listener is behind, drop the event
+		}
+	}
+	return 0
 }
 
-// getWebSocketURL queries the Chrome debug endpoint to get the WebSocket URL
-func getWebSocketURL(ctx context.Context, urlstr string) (string, error) {
-	lctx, cancel := context.WithTimeout(ctx, 5*time.Second)
-	defer cancel()
+// keepalive pings Chrome every interval until the connection is closed. If
+// a ping fails or isn't answered within interval, the connection is marked
+// dead and closed so that pending commands fail instead of waiting for
+// their timeout.
+func (c *cdpClient) keepalive(interval time.Duration) {
+	c.startReader() // pongs are handled while reading
 
-	if strings.Contains(urlstr, "/devtools/browser/") {
-		return forceIP(lctx, urlstr)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.readDone:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		err := c.conn.Ping(ctx)
+		cancel()
+		if err != nil {
+			c.dead.Store(true)
+			c.conn.CloseNow()
+			return
+		}
 	}
+}
 
-	// replace the scheme and path to construct a URL like:
-	// http://127.0.0.1:9222/json/version
-	u, err := url.Parse(urlstr)
-	if err != nil {
-		return "", err
+// checkClosed marks the connection dead if err means the peer went away
+// without a close handshake (websocket status 1006), e.g. because Chrome
+// was killed. The owning client replaces dead connections on next use.
+func (c *cdpClient) checkClosed(err error) {
+	if websocket.CloseStatus(err) == websocket.StatusAbnormalClosure ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, net.ErrClosed) {
+		c.dead.Store(true)
 	}
-	u.Scheme = "http"
-	host, port, err := net.SplitHostPort(u.Host)
+}
+
+// readDevToolsActivePort builds the browser websocket URL from the
+// DevToolsActivePort file Chrome writes to its user data dir. The file holds
+// the port on the first line and the browser path on the second.
+func readDevToolsActivePort(path string) (string, error) {
+	data, err := os.ReadFile(path)
 	if err != nil {
-		return "", err
+		return "", fmt.Errorf("failed to read DevToolsActivePort: %w", err)
 	}
-	host, err = resolveHost(ctx, host)
-	if err != nil {
-		return "", err
+
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	port, err := strconv.Atoi(strings.TrimSpace(lines[0]))
+	if err != nil || port <= 0 || port > 65535 {
+		return "", fmt.Errorf("invalid port in DevToolsActivePort: %q", lines[0])
 	}
-	u.Host = net.JoinHostPort(host, port)
-	u.Path = "/json/version"
+	if len(lines) < 2 || !strings.HasPrefix(strings.TrimSpace(lines[1]), "/devtools/browser/") {
+		return "", fmt.Errorf("browser path not found in DevToolsActivePort")
+	}
+
+	return (&url.URL{
+		Scheme: "ws",
+		Host:   net.JoinHostPort("127.0.0.1", strconv.Itoa(port)),
+		Path:   strings.TrimSpace(lines[1]),
+	}).String(), nil
+}
+
+// getWebSocketURL queries the Chrome debug endpoint to get the WebSocket URL.
+// The query is bound by the deadline of ctx, or 5 seconds if it has none.
+func getWebSocketURL(ctx context.Context, opts *dialOptions, urlstr string) (string, error) {
+	lctx, cancel := ctx, context.CancelFunc(func() {})
+	if _, ok := ctx.Deadline(); !ok {
+		lctx, cancel = context.WithTimeout(ctx, 5*time.Second)
+	}
+	defer cancel()
 
-	// to get "webSocketDebuggerUrl" in the response
-	req, err := http.NewRequestWithContext(lctx, "GET", u.String(), nil)
+	if strings.Contains(urlstr, "/devtools/browser/") {
+		return forceIP(lctx, opts, urlstr)
+	}
+	secure := false
+	if u, err := url.Parse(urlstr); err == nil {
+		secure = isTLS(u)
+	}
+
+	u, err := jsonEndpoint(ctx, opts, urlstr, "/json/version")
 	if err != nil {
 		return "", err
 	}
-	resp, err := http.DefaultClient.Do(req)
+
+	defer recordTiming(ctx, time.Now(), func(t *RefreshTimings) *time.Duration { return &t.Version })
+
+	// to get "webSocketDebuggerUrl" in the response. Chrome may not answer
+	// yet right after starting, so retry transient failures.
+	resp, err := opts.get(lctx, u)
+	for attempt := 0; attempt < opts.versionRetries && transientFailure(resp, err); attempt++ {
+		if deadline, ok := lctx.Deadline(); ok && time.Until(deadline) < opts.versionRetryDelay {
+			break // no time left to retry
+		}
+		if err == nil {
+			resp.Body.Close()
+		}
+		if err := sleepContext(lctx, opts.versionRetryDelay); err != nil {
+			return "", err
+		}
+		resp, err = opts.get(lctx, u)
+	}
 	if err != nil {
 		return "", err
 	}
 	defer resp.Body.Close()
 
+	// Some locked-down proxies block /json/version but still forward the
+	// websocket. As a best-effort fallback, guess the browser endpoint; this
+	// only works with proxies or browsers that don't check the browser id.
+	// A 404 more likely means the port belongs to another service, which
+	// decodeJSONResponse reports.
+	switch resp.StatusCode {
+	case http.StatusForbidden, http.StatusMethodNotAllowed:
+		scheme := "ws"
+		if secure {
+			scheme = "wss"
+		}
+		return (&url.URL{Scheme: scheme, Host: u.Host, Path: "/devtools/browser"}).String(), nil
+	}
+
 	var result map[string]interface{}
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+	if err := decodeJSONResponse(resp, &result); err != nil {
 		return "", err
 	}
 	// the browser will construct the debugger URL using the "host" header of
@@ -151,9 +732,74 @@ func getWebSocketURL(ctx context.Context, urlstr string) (string, error) {
 	if !ok {
 		return "", fmt.Errorf("webSocketDebuggerUrl not found in response")
 	}
+	if secure && strings.HasPrefix(wsURL, "ws://") {
+		// Chrome doesn't know about the TLS terminating in front of it
+		wsURL = "wss://" + strings.TrimPrefix(wsURL, "ws://")
+	}
 	return wsURL, nil
 }
 
+// maxJSONResponse caps the size of a /json endpoint response
+const maxJSONResponse = 1 << 20
+
+// decodeJSONResponse decodes the body of a /json endpoint response into v.
+// Other responses, e.g. an HTML error page because the port belongs to
+// another service, fail with an error quoting the start of the body.
+func decodeJSONResponse(resp *http.Response, v any) error {
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxJSONResponse))
+	if err != nil {
+		return fmt.Errorf("failed to read %s response: %w", resp.Request.URL.Path, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected response from %s: %s (Content-Type %q): %q",
+			resp.Request.URL.Path, resp.Status, resp.Header.Get("Content-Type"), bodySnippet(body))
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("%s did not return JSON, is this a Chrome debug port? (Content-Type %q): %q: %w",
+			resp.Request.URL.Path, resp.Header.Get("Content-Type"), bodySnippet(body), err)
+	}
+	return nil
+}
+
+// bodySnippet returns the start of a response body for error messages
+func bodySnippet(body []byte) string {
+	const max = 200
+	s := strings.TrimSpace(string(body))
+	if len(s) > max {
+		s = s[:max] + "..."
+	}
+	return s
+}
+
+// jsonEndpoint replaces the scheme and path of a debug URL to construct a
+// URL like http://127.0.0.1:9222/json/version. wss:// and https:// URLs
+// map to https, keeping the host name for certificate verification.
+func jsonEndpoint(ctx context.Context, opts *dialOptions, urlstr, path string) (*url.URL, error) {
+	u, err := url.Parse(urlstr)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = path
+	if isTLS(u) {
+		u.Scheme = "https"
+		return u, nil
+	}
+	u.Scheme = "http"
+	if opts.keepHost {
+		return u, nil
+	}
+	host, port, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		return nil, err
+	}
+	host, err = resolveHost(ctx, opts, host)
+	if err != nil {
+		return nil, err
+	}
+	u.Host = net.JoinHostPort(host, port)
+	return u, nil
+}
+
 func mustMarshal(v interface{}) []byte {
 	data, err := json.Marshal(v)
 	if err != nil {
@@ -162,16 +808,24 @@ func mustMarshal(v interface{}) []byte {
 	return data
 }
 
-func forceIP(ctx context.Context, urlstr string) (string, error) {
+// forceIP replaces the host of a websocket URL with its IP address, as
+// Chrome rejects connections with a Host header other than an IP address
+// or localhost, unless opts keeps the host
+func forceIP(ctx context.Context, opts *dialOptions, urlstr string) (string, error) {
 	u, err := url.Parse(urlstr)
 	if err != nil {
 		return "", err
 	}
+	if isTLS(u) || opts.keepHost {
+		// The certificate is issued for the host name, or the host is
+		// needed as is
+		return urlstr, nil
+	}
 	host, port, err := net.SplitHostPort(u.Host)
 	if err != nil {
 		return "", err
 	}
-	host, err = resolveHost(ctx, host)
+	host, err = resolveHost(ctx, opts, host)
 	if err != nil {
 		return "", err
 	}
@@ -181,7 +835,7 @@ func forceIP(ctx context.Context, urlstr string) (string, error) {
 
 // resolveHost tries to resolve a host to be an IP address. If the host is
 // an IP address or "localhost", it returns the host directly.
-func resolveHost(ctx context.Context, host string) (string, error) {
+func resolveHost(ctx context.Context, opts *dialOptions, host string) (string, error) {
 	if host == "localhost" {
 		return host, nil
 	}
@@ -190,35 +844,103 @@ func resolveHost(ctx context.Context, host string) (string, error) {
 		return host, nil
 	}
 
-	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	defer recordTiming(ctx, time.Now(), func(t *RefreshTimings) *time.Duration { return &t.Resolve })
+	addrs, err := opts.resolver().LookupIPAddr(ctx, host)
 	if err != nil {
 		return "", err
 	}
 
-	return addrs[0].IP.String(), nil
+	return selectAddress(addrs, opts.family).String(), nil
 }
 
-func (client *cdpClient) fetchUserAgent(ctx context.Context) (string, error) {
+// AddressFamily selects which address of the debug host to connect to when
+// it resolves to several
+type AddressFamily int
+
+const (
+	// PreferIPv4 uses the first IPv4 address, or the first address if
+	// there is none. This is the default, as Chrome listens on 127.0.0.1.
+	PreferIPv4 AddressFamily = iota
+	// PreferIPv6 uses the first IPv6 address, or the first address if
+	// there is none.
+	PreferIPv6
+	// FirstAddress uses the first address in resolver order.
+	FirstAddress
+)
+
+// selectAddress picks an address of the preferred family from addrs, which
+// must not be empty
+func selectAddress(addrs []net.IPAddr, family AddressFamily) net.IP {
+	if family != FirstAddress {
+		for _, addr := range addrs {
+			if (addr.IP.To4() != nil) == (family == PreferIPv4) {
+				return addr.IP
+			}
+		}
+	}
+	return addrs[0].IP
+}
+
+// fetchVersion fetches the browser version information
+func (client *cdpClient) fetchVersion(ctx context.Context) (*BrowserVersion, error) {
 	result, err := client.execute(ctx, "Browser.getVersion", nil)
 	if err != nil {
-		return "", fmt.Errorf("failed to get browser version: %w", err)
+		return nil, fmt.Errorf("failed to get browser version: %w", err)
 	}
 
-	var version getVersionResponse
+	var version BrowserVersion
 	if err := json.Unmarshal(result, &version); err != nil {
-		return "", fmt.Errorf("failed to parse version response: %w", err)
+		return nil, fmt.Errorf("failed to parse version response: %w", err)
 	}
 
-	return version.UserAgent, nil
+	return &version, nil
 }
 
 // fetchCookies fetches cookies from Chrome (internal method)
-func (client *cdpClient) fetchCookies(ctx context.Context) ([]*cookie, error) {
-	result, err := client.execute(ctx, "Storage.getCookies", nil)
+func (client *cdpClient) fetchCookies(ctx context.Context) ([]*Cookie, error) {
+	return client.fetchContextCookies(ctx, "")
+}
+
+// fetchContextCookies fetches cookies of a browser context. An empty
+// browserContextID selects the default browser context.
+func (client *cdpClient) fetchContextCookies(ctx context.Context, browserContextID string) ([]*Cookie, error) {
+	defer recordTiming(ctx, time.Now(), func(t *RefreshTimings) *time.Duration { return &t.Cookies })
+
+	var params any
+	if browserContextID != "" {
+		params = map[string]any{"browserContextId": browserContextID}
+	}
+
+	result, err := client.execute(ctx, "Storage.getCookies", params)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get cookies: %w", err)
 	}
 
+	return client.parseCookies(result)
+}
+
+// fetchURLCookies fetches the cookies the page would send to any of urls.
+// Network is a page-level domain, so this needs a connection to a page
+// target.
+func (client *cdpClient) fetchURLCookies(ctx context.Context, urls []string) ([]*Cookie, error) {
+	result, err := client.execute(ctx, "Network.getCookies", map[string]any{"urls": urls})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get cookies: %w", err)
+	}
+
+	return client.parseCookies(result)
+}
+
+// parseCookies parses the result of Storage.getCookies or Network.getCookies
+func (client *cdpClient) parseCookies(result json.RawMessage) ([]*Cookie, error) {
+	if client.lenient {
+		cookies, err := unmarshalCookiesLenient(result, client.logger)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse cookies response: %w", err)
+		}
+		return cookies, nil
+	}
+
 	var response getCookiesResponses
 	if err := json.Unmarshal(result, &response); err != nil {
 		return nil, fmt.Errorf("failed to parse cookies response: %w", err)
@@ -226,3 +948,209 @@ func (client *cdpClient) fetchCookies(ctx context.Context) ([]*cookie, error) {
 
 	return response.Cookies, nil
 }
+
+// fetchTargetInfo fetches information about the target the connection is
+// attached to
+func (client *cdpClient) fetchTargetInfo(ctx context.Context) (*targetInfo, error) {
+	result, err := client.execute(ctx, "Target.getTargetInfo", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get target info: %w", err)
+	}
+
+	var response getTargetInfoResponse
+	if err := json.Unmarshal(result, &response); err != nil {
+		return nil, fmt.Errorf("failed to parse target info response: %w", err)
+	}
+
+	return &response.TargetInfo, nil
+}
+
+// evaluate evaluates a JavaScript expression, awaiting it if it is a
+// promise, and returns its value as JSON. Runtime is a page-level domain.
+func (client *cdpClient) evaluate(ctx context.Context, expr string) (json.RawMessage, error) {
+	result, err := client.execute(ctx, "Runtime.evaluate", map[string]any{
+		"expression":    expr,
+		"returnByValue": true,
+		"awaitPromise":  true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to evaluate: %w", err)
+	}
+
+	var response evaluateResponse
+	if err := json.Unmarshal(result, &response); err != nil {
+		return nil, fmt.Errorf("failed to parse evaluate response: %w", err)
+	}
+	if e := response.ExceptionDetails; e != nil {
+		if e.Exception != nil && e.Exception.Description != "" {
+			return nil, fmt.Errorf("evaluation threw: %s", e.Exception.Description)
+		}
+		return nil, fmt.Errorf("evaluation threw: %s", e.Text)
+	}
+	return response.Result.Value, nil
+}
+
+// navigate navigates the page to url and waits for its load event. Page is
+// a page-level domain, so this needs a connection to a page target.
+func (client *cdpClient) navigate(ctx context.Context, url string) error {
+	if _, err := client.execute(ctx, "Page.enable", nil); err != nil {
+		return fmt.Errorf("failed to enable page events: %w", err)
+	}
+
+	// Subscribe before navigating so the event can't be missed
+	loaded, unsubscribe := client.subscribe("Page.loadEventFired")
+	defer unsubscribe()
+
+	result, err := client.execute(ctx, "Page.navigate", map[string]any{"url": url})
+	if err != nil {
+		return fmt.Errorf("failed to navigate: %w", err)
+	}
+
+	var response navigateResponse
+	if err := json.Unmarshal(result, &response); err != nil {
+		return fmt.Errorf("failed to parse navigate response: %w", err)
+	}
+	if response.ErrorText != "" {
+		return fmt.Errorf("failed to navigate to %s: %s", url, response.ErrorText)
+	}
+	if response.LoaderID == "" {
+		return nil // same-document navigation, no load event follows
+	}
+
+	select {
+	case _, ok := <-loaded:
+		if !ok {
+			return fmt.Errorf("connection lost while waiting for %s to load", url)
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("failed to wait for %s to load: %w", url, ctx.Err())
+	}
+}
+
+// fetchBrowserContexts lists the browser contexts other than the default one
+func (client *cdpClient) fetchBrowserContexts(ctx context.Context) ([]string, error) {
+	result, err := client.execute(ctx, "Target.getBrowserContexts", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get browser contexts: %w", err)
+	}
+
+	var response getBrowserContextsResponse
+	if err := json.Unmarshal(result, &response); err != nil {
+		return nil, fmt.Errorf("failed to parse browser contexts response: %w", err)
+	}
+
+	return response.BrowserContextIDs, nil
+}
+
+// setCookies sets cookies in Chrome's default browser context. Partition
+// keys are sent until the browser rejects them; the cookies are then sent
+// again without them, unpartitioned.
+func (client *cdpClient) setCookies(ctx context.Context, cookies []*cookieParam) error {
+	partitioned := slices.ContainsFunc(cookies, func(p *cookieParam) bool { return p.PartitionKey != nil })
+	if partitioned && client.noPartitionKeys.Load() {
+		cookies = withoutPartitionKeys(cookies)
+	}
+	_, err := client.execute(ctx, "Storage.setCookies", map[string]any{"cookies": cookies})
+	var cdpErr *CDPError
+	if partitioned && !client.noPartitionKeys.Load() && errors.As(err, &cdpErr) && cdpErr.Code == cdpInvalidParams {
+		client.noPartitionKeys.Store(true)
+		_, err = client.execute(ctx, "Storage.setCookies", map[string]any{"cookies": withoutPartitionKeys(cookies)})
+	}
+	if err != nil {
+		return fmt.Errorf("failed to set cookies: %w", err)
+	}
+	return nil
+}
+
+// cdpInvalidParams is the CDPError code of commands with invalid params
+const cdpInvalidParams = -32602
+
+// withoutPartitionKeys returns copies of cookies without partition keys
+func withoutPartitionKeys(cookies []*cookieParam) []*cookieParam {
+	stripped := make([]*cookieParam, len(cookies))
+	for i, cookie := range cookies {
+		copied := *cookie
+		copied.PartitionKey = nil
+		stripped[i] = &copied
+	}
+	return stripped
+}
+
+// clearCookies deletes all cookies of Chrome's default browser context
+func (client *cdpClient) clearCookies(ctx context.Context) error {
+	_, err := client.execute(ctx, "Storage.clearCookies", nil)
+	if err != nil {
+		return fmt.Errorf("failed to clear cookies: %w", err)
+	}
+	return nil
+}
+
+// deleteCookies deletes the cookies named name that match url. Network is a
+// page-level domain, so this needs a connection to a page target.
+func (client *cdpClient) deleteCookies(ctx context.Context, name, url string) error {
+	_, err := client.execute(ctx, "Network.deleteCookies", map[string]any{"name": name, "url": url})
+	if err != nil {
+		return fmt.Errorf("failed to delete cookies: %w", err)
+	}
+	return nil
+}
+
+// fetchLocalStorage reads the localStorage entries of origin. DOMStorage
+// is a page-level domain, so this needs a connection to a page target.
+func (client *cdpClient) fetchLocalStorage(ctx context.Context, origin string) ([][]string, error) {
+	if _, err := client.execute(ctx, "DOMStorage.enable", nil); err != nil {
+		return nil, fmt.Errorf("failed to enable DOM storage: %w", err)
+	}
+
+	result, err := client.execute(ctx, "DOMStorage.getDOMStorageItems", map[string]any{
+		"storageId": map[string]any{
+			"securityOrigin": origin,
+			"isLocalStorage": true,
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get DOM storage items: %w", err)
+	}
+
+	var response getDOMStorageItemsResponse
+	if err := json.Unmarshal(result, &response); err != nil {
+		return nil, fmt.Errorf("failed to parse DOM storage response: %w", err)
+	}
+
+	return response.Entries, nil
+}
+
+// fetchIndexedDBValue reads the value stored under a string key of an
+// IndexedDB object store. IndexedDB is a page-level domain, so this needs a
+// connection to a page target.
+func (client *cdpClient) fetchIndexedDBValue(ctx context.Context, origin, db, store, key string) (*remoteObject, error) {
+	keyParam := map[string]any{"type": "string", "string": key}
+	result, err := client.execute(ctx, "IndexedDB.requestData", map[string]any{
+		"securityOrigin":  origin,
+		"databaseName":    db,
+		"objectStoreName": store,
+		"indexName":       "",
+		"skipCount":       0,
+		"pageSize":        1,
+		"keyRange": map[string]any{
+			"lower":     keyParam,
+			"upper":     keyParam,
+			"lowerOpen": false,
+			"upperOpen": false,
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to request IndexedDB data: %w", err)
+	}
+
+	var response requestDataResponse
+	if err := json.Unmarshal(result, &response); err != nil {
+		return nil, fmt.Errorf("failed to parse IndexedDB response: %w", err)
+	}
+	if len(response.ObjectStoreDataEntries) == 0 {
+		return nil, fmt.Errorf("IndexedDB key %q not found in %s/%s", key, db, store)
+	}
+
+	return &response.ObjectStoreDataEntries[0].Value, nil
+}
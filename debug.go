@@ -0,0 +1,154 @@
+package cdphttp
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CookieReport explains which of the cookies last fetched from Chrome match
+// a request URL and why the others don't
+type CookieReport struct {
+	URL      string
+	Total    int               // cookies fetched from Chrome
+	Matched  []string          // names of cookies sent with the request
+	Rejected map[string]string // cookie "name@domain/path" to rejection reason
+}
+
+func (r CookieReport) String() string {
+	u, _ := url.Parse(r.URL)
+	host, path := r.URL, ""
+	if u != nil {
+		host, path = u.Hostname(), u.Path
+	}
+	msg := fmt.Sprintf("%d cookies in jar, %d matched host %s path %s", r.Total, len(r.Matched), host, path)
+	if len(r.Matched) > 0 {
+		msg += " (" + strings.Join(r.Matched, ", ") + ")"
+	}
+
+	reasons := make([]string, 0, len(r.Rejected))
+	for cookie, reason := range r.Rejected {
+		reasons = append(reasons, cookie+": "+reason)
+	}
+	sort.Strings(reasons)
+	if len(reasons) > 0 {
+		msg += "; rejected " + strings.Join(reasons, ", ")
+	}
+	return msg
+}
+
+// explainCookies builds a CookieReport for u from the last fetched cookies
+func (c *client) explainCookies(u *url.URL) CookieReport {
+	cookies := c.lastCookies()
+	report := CookieReport{
+		URL:      u.String(),
+		Total:    len(cookies),
+		Rejected: make(map[string]string),
+	}
+	for _, cookie := range cookies {
+		if reason := c.jarMismatch(cookie, u); reason != "" {
+			report.Rejected[cookie.Name+"@"+cookie.Domain+cookie.Path] = reason
+			continue
+		}
+		report.Matched = append(report.Matched, cookie.Name)
+	}
+	sort.Strings(report.Matched)
+	return report
+}
+
+// lastCookies returns the cookies last fetched from Chrome. They are copied
+// so that the cookie filter isn't called with c.mu held.
+func (c *client) lastCookies() []*Cookie {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	cookies := make([]*Cookie, 0, len(c.prevCookies))
+	for _, cookie := range c.prevCookies {
+		cookies = append(cookies, cookie)
+	}
+	return cookies
+}
+
+// jarMismatch returns why the jar would not send cookie to u, or "" if it
+// would: either storeCookie left it out or it doesn't match u. Host-only
+// cookies without a domain are matched against the host they are stored
+// under, and the expiry is the one the jar uses, e.g. after WithMaxExpiry.
+func (c *client) jarMismatch(cookie *Cookie, u *url.URL) string {
+	if reason := c.excludedReason(cookie); reason != "" {
+		return reason
+	}
+	if cookie.Domain == "" {
+		stored := *cookie
+		stored.Domain = c.cookieURL(cookie).Host
+		cookie = &stored
+	}
+	if reason := cookieMismatch(cookie, u); reason != "" {
+		return reason
+	}
+	if expires := c.toHTTPCookie(cookie).Expires; !expires.IsZero() && expires.Before(time.Now()) {
+		return "expired"
+	}
+	return ""
+}
+
+// cookieMismatch returns why cookie would not be sent to u, or "" if it
+// would, following the matching rules of RFC 6265 section 5.4. A domain
+// without a leading dot marks a host-only cookie, as in the jar.
+func cookieMismatch(cookie *Cookie, u *url.URL) string {
+	host := strings.ToLower(u.Hostname())
+	domain := strings.ToLower(cookie.Domain)
+	if strings.HasPrefix(domain, ".") {
+		domain = domain[1:]
+		if host != domain && !strings.HasSuffix(host, "."+domain) {
+			return "domain mismatch"
+		}
+	} else if host != domain {
+		return "host mismatch"
+	}
+
+	path := u.Path
+	if path == "" {
+		path = "/"
+	}
+	if cookie.Path != "" && path != cookie.Path {
+		if !strings.HasPrefix(path, cookie.Path) ||
+			(!strings.HasSuffix(cookie.Path, "/") && path[len(cookie.Path)] != '/') {
+			return "path mismatch"
+		}
+	}
+
+	if cookie.Secure && u.Scheme != "https" {
+		return "secure cookie on insecure request"
+	}
+	if !cookie.Session && cookie.Expires > 0 && cookieExpiry(cookie.Expires).Before(time.Now()) {
+		return "expired"
+	}
+	return ""
+}
+
+// debugCookieHeaders describes the last fetched cookies matching u, one
+// entry per cookie in Set-Cookie attribute style without the value, e.g.
+// "sid; Domain=.example.com; Path=/; Secure; HttpOnly"
+func (c *client) debugCookieHeaders(u *url.URL) []string {
+	var headers []string
+	for _, cookie := range c.lastCookies() {
+		if c.jarMismatch(cookie, u) != "" {
+			continue
+		}
+		attrs := []string{cookie.Name, "Domain=" + cookie.Domain, "Path=" + cookiePath(cookie.Path)}
+		if expires := c.toHTTPCookie(cookie).Expires; !expires.IsZero() {
+			attrs = append(attrs, "Expires="+expires.UTC().Format(http.TimeFormat))
+		}
+		if cookie.Secure {
+			attrs = append(attrs, "Secure")
+		}
+		if cookie.HTTPOnly {
+			attrs = append(attrs, "HttpOnly")
+		}
+		headers = append(headers, strings.Join(attrs, "; "))
+	}
+	sort.Strings(headers)
+	return headers
+}
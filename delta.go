@@ -0,0 +1,89 @@
+package cdphttp
+
+import "net/http"
+
+// CookieDelta describes how Chrome's cookies changed between two refreshes
+type CookieDelta struct {
+	Added   []*http.Cookie
+	Removed []*http.Cookie
+	Changed []*http.Cookie
+}
+
+// Empty reports whether no cookies changed
+func (d CookieDelta) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// cookieKey identifies a cookie the way browsers do. Partitioned cookies
+// are distinct from unpartitioned ones of the same name.
+type cookieKey struct {
+	Name      string
+	Domain    string
+	Path      string
+	Partition CookiePartitionKey
+}
+
+// keyOf returns the key of a cookie
+func keyOf(c *Cookie) cookieKey {
+	key := cookieKey{Name: c.Name, Domain: c.Domain, Path: c.Path}
+	if c.PartitionKey != nil {
+		key.Partition = *c.PartitionKey
+	}
+	return key
+}
+
+// cookieSet indexes cookies by their key
+func cookieSet(cookies []*Cookie) map[cookieKey]*Cookie {
+	set := make(map[cookieKey]*Cookie, len(cookies))
+	for _, c := range cookies {
+		set[keyOf(c)] = c
+	}
+	return set
+}
+
+// cookieDiff is a CookieDelta of CDP cookies
+type cookieDiff struct {
+	added   []*Cookie
+	removed []*Cookie
+	changed []*Cookie
+}
+
+// diffCookies compares two cookie sets
+func diffCookies(prev, current map[cookieKey]*Cookie) cookieDiff {
+	var diff cookieDiff
+	for key, c := range current {
+		old, ok := prev[key]
+		switch {
+		case !ok:
+			diff.added = append(diff.added, c)
+		case !cookiesEqual(old, c):
+			diff.changed = append(diff.changed, c)
+		}
+	}
+	for key, c := range prev {
+		if _, ok := current[key]; !ok {
+			diff.removed = append(diff.removed, c)
+		}
+	}
+	return diff
+}
+
+// export converts the diff to a CookieDelta
+func (d cookieDiff) export(c *client) CookieDelta {
+	return CookieDelta{
+		Added:   c.toHTTPCookies(d.added),
+		Removed: c.toHTTPCookies(d.removed),
+		Changed: c.toHTTPCookies(d.changed),
+	}
+}
+
+// cookiesEqual reports whether two cookies have the same attributes
+func cookiesEqual(a, b *Cookie) bool {
+	ak, bk := a.PartitionKey, b.PartitionKey
+	if (ak == nil) != (bk == nil) || (ak != nil && *ak != *bk) {
+		return false
+	}
+	ac, bc := *a, *b
+	ac.PartitionKey, bc.PartitionKey = nil, nil
+	return ac == bc
+}
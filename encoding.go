@@ -0,0 +1,56 @@
+package cdphttp
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// ChromeAcceptEncoding is the Accept-Encoding header sent by current Chrome
+const ChromeAcceptEncoding = "gzip, deflate, br, zstd"
+
+// decodeBody transparently decompresses gzip and deflate responses, as the
+// transport would have done had we not set Accept-Encoding ourselves. Other
+// encodings are left to the caller.
+func decodeBody(resp *http.Response) {
+	var newReader func(io.Reader) (io.Reader, error)
+	switch strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding"))) {
+	case "gzip":
+		newReader = func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) }
+	case "deflate":
+		newReader = func(r io.Reader) (io.Reader, error) { return zlib.NewReader(r) }
+	default:
+		return
+	}
+
+	resp.Body = &decodedBody{raw: resp.Body, newReader: newReader}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+}
+
+// decodedBody decompresses the raw body, lazily so that reading the
+// compression header doesn't block RoundTrip
+type decodedBody struct {
+	raw       io.ReadCloser
+	newReader func(io.Reader) (io.Reader, error)
+	r         io.Reader
+	err       error
+}
+
+func (b *decodedBody) Read(p []byte) (int, error) {
+	if b.r == nil && b.err == nil {
+		b.r, b.err = b.newReader(b.raw)
+	}
+	if b.err != nil {
+		return 0, b.err
+	}
+	return b.r.Read(p)
+}
+
+func (b *decodedBody) Close() error {
+	return b.raw.Close()
+}
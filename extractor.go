@@ -2,23 +2,132 @@ package cdphttp
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
 	"net/http"
 	"net/http/cookiejar"
 	"net/url"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type client struct {
-	Jar *cookiejar.Jar
+	Jar http.CookieJar
 
 	mu        sync.RWMutex
 	cdpClient *cdpClient
 	debugURL  string
 	userAgent string
 
+	// userAgentFetched is when userAgent was last fetched over the current
+	// connection; zero after reconnecting
+	userAgentFetched time.Time
+
+	// webSocketURL, if set, is dialed instead of discovering the browser
+	// endpoint via debugURL's /json/version. directWebSocket dials it as
+	// is, without resolving its host.
+	webSocketURL    string
+	directWebSocket bool
+
+	// activePortFile is Chrome's DevToolsActivePort file to read the
+	// websocket URL from
+	activePortFile string
+
+	// endpoints, if set, are debug URLs to fail over between instead of
+	// debugURL. activeEndpoint indexes the one to connect to first;
+	// endpoint is the URL of the current connection.
+	endpoints      []string
+	activeEndpoint atomic.Int64
+	endpoint       string
+
+	// protocolVersion is the CDP version reported by Browser.getVersion
+	protocolVersion string
+
+	// dialFunc opens the CDP connection; tests replace it to simulate failures
+	dialFunc func(ctx context.Context, debugURL string) (*cdpClient, error)
+	dialOpts dialOptions
+
+	// backoff paces reconnect attempts
+	backoff         Backoff
+	maxReconnects   int
+	connectRetries  int
+	connectFailures atomic.Int64 // consecutive failed connects
+
 	lastRefresh time.Time
 	cacheTTL    time.Duration
+
+	// refreshCount and lastError are reported by Stats
+	refreshCount    int64
+	lastError       error
+	lastCookieCount int
+
+	// paused stops all contact with Chrome, see Pause
+	paused atomic.Bool
+
+	// closed is set by Close; closeCtx is cancelled with ErrClosed then to
+	// abort in-flight refreshes
+	closed      atomic.Bool
+	closeCtx    context.Context
+	closeCancel context.CancelCauseFunc
+
+	// connected is set once a connection succeeded; reconcile requests a
+	// refresh regardless of the cache TTL after a reconnect
+	connected            bool
+	reconcile            atomic.Bool
+	reconcileOnReconnect bool
+
+	// jarMu serializes applying a refresh to the jar and prevCookies so that
+	// snapshots never observe a half-applied refresh. Lock before mu.
+	jarMu       sync.RWMutex
+	prevCookies map[cookieKey]*Cookie // cookies from the last refresh
+	imported    map[cookieKey]*Cookie // seeded or imported cookies Chrome hasn't replaced
+	jar         *resettableJar        // Jar, emptied by ClearCookies
+
+	// Settings from Options
+	name                string
+	shardJar            bool
+	preferTarget        bool
+	targetFilter        func(Target) bool
+	psl                 cookiejar.PublicSuffixList
+	allowSingleLabel    bool
+	maxExpiry           time.Duration
+	sessionCookieTTL    time.Duration
+	defaultCookieDomain func() string
+	cacheValidator      func(lastRefresh time.Time, cookies []*http.Cookie) bool
+	cookieFilter        func(*http.Cookie) bool
+	includePartitioned  bool
+	minCookies          int
+	lenientJSON         bool
+	matchResponse       ResponseMatcher
+	onUnmatchedResponse func(id int64, message []byte)
+	adaptiveTimeout     *adaptiveTimeout
+	commandTimeout      time.Duration
+	keepaliveInterval   time.Duration
+	initialCookies      []*http.Cookie
+	debugCookieHeader   bool
+	acceptEncoding      string
+	userAgentOverride   string
+	buildUserAgent      func(BrowserVersion) string
+	userAgentRefresh    time.Duration
+	cookiePollInterval  time.Duration
+	baseTransport       http.RoundTripper
+	recorder            *recorder
+	onStale             func(age time.Duration)
+	onUserAgentChange   func(old, new string)
+	onRefresh           func(cookies []*http.Cookie, at time.Time)
+	onCookieChange      func(CookieDelta)
+	onCookieReport      func(CookieReport)
+	logger              *slog.Logger
+
+	// autoRefreshMu guards the background refresh started by StartAutoRefresh
+	autoRefreshMu     sync.Mutex
+	autoRefreshCancel context.CancelFunc
+	autoRefreshDone   chan struct{}
 }
 
 // connect attempts to connect to Chrome, returns error if connection fails
@@ -26,20 +135,96 @@ func (c *client) connect(ctx context.Context) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	if c.closed.Load() {
+		return ErrClosed
+	}
+
 	// Already connected
 	if c.cdpClient != nil {
-		return nil
+		if !c.cdpClient.dead.Load() {
+			return nil
+		}
+		// Connection closed abnormally, replace it
+		c.cdpClient.Close()
+		c.cdpClient = nil
 	}
 
-	cdpClient, err := createCDPClient(ctx, c.debugURL)
-	if err != nil {
-		return err
+	// Try the endpoints in turn, starting with the one last connected to
+	attempts := 1
+	if len(c.endpoints) > 1 && c.activePortFile == "" && c.webSocketURL == "" {
+		attempts = len(c.endpoints)
 	}
+	var cdpClient *cdpClient
+	var debugURL string
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			c.activeEndpoint.Store((c.activeEndpoint.Load() + 1) % int64(len(c.endpoints)))
+		}
+		var err error
+		if debugURL, err = c.endpointURL(); err != nil {
+			return &ConnectError{URL: c.debugURL, Err: err}
+		}
+		if cdpClient, err = c.dialFunc(ctx, debugURL); err == nil {
+			break
+		}
+		c.logger.Warn("failed to connect to Chrome", "url", debugURL, "err", err)
+		if attempt+1 >= attempts || ctx.Err() != nil {
+			return &ConnectError{URL: debugURL, Err: err}
+		}
+	}
+	c.endpoint = debugURL
+	c.configure(cdpClient)
+	c.logger.Info("connected to Chrome", "url", debugURL, "reconnect", c.connected)
+	c.userAgentFetched = time.Time{}
+
+	if c.connected && c.reconcileOnReconnect {
+		// Cookies may have changed while we were disconnected
+		c.reconcile.Store(true)
+	}
+	c.connected = true
 
 	c.cdpClient = cdpClient
 	return nil
 }
 
+// endpointURL returns the debug or websocket URL to connect to
+func (c *client) endpointURL() (string, error) {
+	if c.activePortFile != "" {
+		// Read on every connect since Chrome picks a new port on restart
+		return readDevToolsActivePort(c.activePortFile)
+	}
+	if c.webSocketURL == "" && len(c.endpoints) > 0 {
+		return c.endpoints[c.activeEndpoint.Load()], nil
+	}
+	if c.webSocketURL != "" {
+		if c.directWebSocket {
+			u, err := url.Parse(c.webSocketURL)
+			if err != nil {
+				return "", err
+			}
+			if u.Scheme != "ws" && u.Scheme != "wss" {
+				return "", fmt.Errorf("websocket URL %q must use ws or wss", c.webSocketURL)
+			}
+		}
+		return c.webSocketURL, nil
+	}
+	return c.debugURL, nil
+}
+
+// configure applies the client's settings to a new connection
+func (c *client) configure(cdpClient *cdpClient) {
+	cdpClient.recorder = c.recorder
+	cdpClient.lenient = c.lenientJSON
+	cdpClient.matchResponse = c.matchResponse
+	cdpClient.onUnmatched = c.onUnmatchedResponse
+	cdpClient.logger = c.logger
+	cdpClient.adaptiveTimeout = c.adaptiveTimeout
+	cdpClient.commandTimeout = c.commandTimeout
+	if c.keepaliveInterval > 0 {
+		go cdpClient.keepalive(c.keepaliveInterval)
+	}
+}
+
 // disconnect closes the CDP connection
 func (c *client) disconnect() {
 	c.mu.Lock()
@@ -48,134 +233,1286 @@ func (c *client) disconnect() {
 	if c.cdpClient != nil {
 		c.cdpClient.Close()
 		c.cdpClient = nil
+		c.logger.Debug("disconnected from Chrome")
 	}
 }
 
-// ensureConnection attempts to connect if not already connected
-// Returns the current CDP client or nil if not connected
-func (c *client) ensureConnection(ctx context.Context) *cdpClient {
+// ensureConnection attempts to connect if not already connected.
+// Returns the current CDP client, or an error matching ErrChromeUnavailable
+// and wrapping the *ConnectError if connecting failed.
+func (c *client) ensureConnection(ctx context.Context) (*cdpClient, error) {
 	c.mu.RLock()
-	if c.cdpClient != nil {
+	if c.cdpClient != nil && !c.cdpClient.dead.Load() {
 		defer c.mu.RUnlock()
-		return c.cdpClient
+		return c.cdpClient, nil
 	}
 	c.mu.RUnlock()
 
-	// Try to connect
-	if err := c.connect(ctx); err != nil {
-		return nil
+	// Try to connect, retrying with backoff. Failures are counted across
+	// calls so that the delays keep growing while Chrome stays down.
+	budget := c.connectBudget(ctx)
+	for {
+		err := c.connect(ctx)
+		if err == nil {
+			c.connectFailures.Store(0)
+			break
+		}
+		if err == ErrClosed {
+			return nil, err
+		}
+		failures := c.connectFailures.Add(1)
+		c.recordError(err)
+		if !budget.take() {
+			return nil, fmt.Errorf("%w: %w", ErrChromeUnavailable, err)
+		}
+		if serr := sleepContext(ctx, c.backoff.Next(int(failures-1))); serr != nil {
+			return nil, fmt.Errorf("%w: %w", ErrChromeUnavailable, err)
+		}
 	}
 
 	c.mu.RLock()
 	defer c.mu.RUnlock()
-	return c.cdpClient
+	return c.cdpClient, nil
+}
+
+type connectBudgetKey struct{}
+
+// connectBudget is the number of connection retries left to a request,
+// shared by retries after failed dials and reconnects after failed fetches
+type connectBudget struct {
+	retries int
+}
+
+// take uses up one retry, reporting false if none is left
+func (b *connectBudget) take() bool {
+	if b.retries <= 0 {
+		return false
+	}
+	b.retries--
+	return true
+}
+
+// connectBudget returns the budget of the request ctx belongs to, or a
+// fresh one of connectRetries retries
+func (c *client) connectBudget(ctx context.Context) *connectBudget {
+	if b, ok := ctx.Value(connectBudgetKey{}).(*connectBudget); ok {
+		return b
+	}
+	return &connectBudget{retries: c.connectRetries}
+}
+
+// AwaitConnection connects to Chrome, retrying with the configured backoff
+// until it succeeds, maxAttempts attempts failed (no limit if <= 0) or ctx
+// is done. It returns the number of attempts made and the last error.
+func (c *client) AwaitConnection(ctx context.Context, maxAttempts int) (attempts int, err error) {
+	for {
+		attempts++
+		if err = c.connect(ctx); err == nil {
+			return attempts, nil
+		}
+		if err == ErrClosed || maxAttempts > 0 && attempts >= maxAttempts {
+			return attempts, err
+		}
+
+		if err := sleepContext(ctx, c.backoff.Next(attempts-1)); err != nil {
+			return attempts, err
+		}
+	}
+}
+
+// sleepContext waits for d or until ctx is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
 }
 
 // RefreshCookies fetches fresh cookies from Chrome
 // Returns error only if Chrome is unavailable AND cache is expired
 func (c *client) RefreshCookies(ctx context.Context) error {
-	cdpClient := c.ensureConnection(ctx)
-	if cdpClient == nil {
-		// Check if cache is still valid
-		c.mu.RLock()
-		cacheValid := time.Since(c.lastRefresh) < c.cacheTTL
-		c.mu.RUnlock()
+	_, err := c.RefreshCookiesN(ctx)
+	return err
+}
 
-		if cacheValid {
-			return nil // Use cached cookies
-		}
-		return ErrChromeUnavailable
+// RefreshCookiesN is like RefreshCookies, but returns how many cookies
+// Chrome reported, or -1 if the cached cookies were kept because Chrome is
+// unavailable.
+func (c *client) RefreshCookiesN(ctx context.Context) (int, error) {
+	cookies, ok, err := c.fetchFresh(ctx)
+	if !ok {
+		return -1, err
 	}
 
-	cookies, err := cdpClient.fetchCookies(ctx)
+	// Update cookies in jar
+	c.jarMu.Lock()
+	for _, cookie := range cookies {
+		c.storeCookie(cookie)
+	}
+
+	now := time.Now()
+	current := cookieSet(cookies)
+	c.mu.Lock()
+	var changes CookieDelta
+	if c.onCookieChange != nil {
+		changes = diffCookies(c.prevCookies, current).export(c)
+	}
+	c.prevCookies = current
+	c.dropImported(current)
+	c.lastRefresh = now
+	c.lastCookieCount = len(cookies)
+	c.refreshCount++
+	c.mu.Unlock()
+	c.reconcile.Store(false)
+	c.jarMu.Unlock()
+
+	c.notifyRefresh(cookies, now)
+	c.notifyChange(changes)
+	return len(cookies), nil
+}
+
+// LastCookieCount returns how many cookies Chrome reported in the last
+// successful refresh. Zero cookies usually means the wrong browser or
+// profile is attached.
+func (c *client) LastCookieCount() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.lastCookieCount
+}
+
+// notifyRefresh calls the WithOnRefresh callback, if any. It must be called
+// without holding locks since the callback may use the client.
+func (c *client) notifyRefresh(cookies []*Cookie, at time.Time) {
+	if c.onRefresh != nil {
+		c.onRefresh(c.toHTTPCookies(cookies), at)
+	}
+}
+
+// notifyChange calls the WithOnCookieChange callback, if any, unless the
+// delta is empty. Like notifyRefresh, it must be called without locks.
+func (c *client) notifyChange(delta CookieDelta) {
+	if c.onCookieChange != nil && !delta.Empty() {
+		c.onCookieChange(delta)
+	}
+}
+
+// RefreshDelta fetches fresh cookies from Chrome like RefreshCookies, but
+// only stores the cookies that were added, removed or changed since the
+// previous refresh and returns them. If Chrome is unavailable and the cache
+// is still valid, it returns an empty delta.
+func (c *client) RefreshDelta(ctx context.Context) (CookieDelta, error) {
+	cookies, ok, err := c.fetchFresh(ctx)
+	if !ok {
+		return CookieDelta{}, err
+	}
+
+	current := cookieSet(cookies)
+	c.jarMu.Lock()
+
+	c.mu.RLock()
+	delta := diffCookies(c.prevCookies, current)
+	c.mu.RUnlock()
+
+	for _, cookie := range delta.added {
+		c.storeCookie(cookie)
+	}
+	for _, cookie := range delta.changed {
+		c.storeCookie(cookie)
+	}
+	for _, cookie := range delta.removed {
+		c.removeCookie(cookie)
+	}
+
+	now := time.Now()
+	c.mu.Lock()
+	c.prevCookies = current
+	c.dropImported(current)
+	c.dropImported(cookieSet(delta.removed))
+	c.lastRefresh = now
+	c.lastCookieCount = len(cookies)
+	c.refreshCount++
+	c.mu.Unlock()
+	c.reconcile.Store(false)
+	exported := delta.export(c)
+	c.jarMu.Unlock()
+
+	c.notifyRefresh(cookies, now)
+	c.notifyChange(exported)
+	return exported, nil
+}
+
+// fetchFresh fetches cookies from Chrome, reconnecting up to maxReconnects
+// times with backoff if the connection turns out to be stale. All dials of
+// the refresh together retry at most connectRetries times. ok is false if no cookies could be
+// fetched, in which case err is nil if the cache is still valid.
+func (c *client) fetchFresh(ctx context.Context) (cookies []*Cookie, ok bool, err error) {
+	if c.closed.Load() {
+		return nil, false, ErrClosed
+	}
+	if c.paused.Load() {
+		return nil, false, ErrPaused
+	}
+
+	// Abort the refresh if the client is closed meanwhile
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	stop := context.AfterFunc(c.closeCtx, func() { cancel(ErrClosed) })
+	defer stop()
+
+	start := time.Now()
+	c.logger.Debug("refreshing cookies")
+
+	// Connection retries and reconnects share one budget, bounding how long
+	// a refresh keeps dialing
+	budget := &connectBudget{retries: c.connectRetries}
+	ctx = context.WithValue(ctx, connectBudgetKey{}, budget)
+
+	cdpClient, err := c.ensureConnection(ctx)
 	if err != nil {
+		if c.closed.Load() {
+			return nil, false, ErrClosed
+		}
+		return nil, false, c.fallbackToCache(err)
+	}
+
+	cookies, err = cdpClient.fetchCookies(ctx)
+	for reconnects := 0; err != nil; reconnects++ {
+		if c.closed.Load() {
+			return nil, false, ErrClosed
+		}
 		// Connection might be stale, try to reconnect
 		c.disconnect()
-		cdpClient = c.ensureConnection(ctx)
-		if cdpClient == nil {
-			c.mu.RLock()
-			cacheValid := time.Since(c.lastRefresh) < c.cacheTTL
-			c.mu.RUnlock()
-			if cacheValid {
-				return nil
+		if reconnects >= c.maxReconnects || !budget.take() {
+			return nil, false, c.fallbackToCache(err)
+		}
+		c.logger.Info("reconnecting to Chrome", "attempt", reconnects+1, "err", err)
+		if reconnects > 0 {
+			if err := sleepContext(ctx, c.backoff.Next(reconnects-1)); err != nil {
+				return nil, false, c.fallbackToCache(err)
 			}
-			return ErrChromeUnavailable
 		}
 
-		cookies, err = cdpClient.fetchCookies(ctx)
-		if err != nil {
-			c.disconnect()
-			c.mu.RLock()
-			cacheValid := time.Since(c.lastRefresh) < c.cacheTTL
-			c.mu.RUnlock()
-			if cacheValid {
-				return nil
-			}
-			return err
+		if cdpClient, err = c.ensureConnection(ctx); err != nil {
+			continue
 		}
+		cookies, err = cdpClient.fetchCookies(ctx)
+	}
+
+	if len(cookies) < c.minCookies {
+		err := fmt.Errorf("%w: got %d, want at least %d", ErrTooFewCookies, len(cookies), c.minCookies)
+		c.recordError(err)
+		c.logger.Warn("cookie refresh failed", "err", err)
+		return nil, false, err
 	}
 
-	// Update user agent if not set
+	// Update user agent once per connection and when it is due, or on every
+	// refresh when watching for changes. A failed fetch keeps the old one.
 	c.mu.RLock()
-	hasUserAgent := c.userAgent != ""
+	fetched := c.userAgentFetched
 	c.mu.RUnlock()
 
-	if !hasUserAgent {
-		userAgent, err := cdpClient.fetchUserAgent(ctx)
+	due := fetched.IsZero() || c.userAgentRefresh > 0 && time.Since(fetched) >= c.userAgentRefresh
+	if due || c.onUserAgentChange != nil {
+		version, err := cdpClient.fetchVersion(ctx)
 		if err == nil {
 			c.mu.Lock()
-			c.userAgent = userAgent
+			old := c.userAgent
+			c.userAgent = c.buildUserAgent(*version)
+			c.protocolVersion = version.ProtocolVersion
+			c.userAgentFetched = time.Now()
+			ua := c.userAgent
 			c.mu.Unlock()
+
+			if old != "" && old != ua && c.onUserAgentChange != nil {
+				c.onUserAgentChange(old, ua)
+			}
 		}
 	}
 
-	// Update cookies in jar
+	c.logger.Debug("refreshed cookies", "count", len(cookies), "duration", time.Since(start))
+	return cookies, true, nil
+}
+
+// storeCookie stores a CDP cookie in the jar
+func (c *client) storeCookie(cookie *Cookie) {
+	if c.excludedReason(cookie) != "" {
+		return
+	}
+	c.Jar.SetCookies(c.cookieURL(cookie), []*http.Cookie{jarCookie(c.toHTTPCookie(cookie))})
+}
+
+// excludedReason returns why storeCookie leaves cookie out of the jar, or
+// "" if it stores it
+func (c *client) excludedReason(cookie *Cookie) string {
+	if c.cookieURL(cookie) == nil {
+		return "no domain"
+	}
+	if cookie.PartitionKey != nil && !c.includePartitioned {
+		return "partitioned cookie excluded"
+	}
+	if c.cookieFilter != nil && !c.cookieFilter(c.toHTTPCookie(cookie)) {
+		return "excluded by cookie filter"
+	}
+	return ""
+}
+
+// removeCookie deletes a CDP cookie from the jar
+func (c *client) removeCookie(cookie *Cookie) {
+	if cookie.PartitionKey != nil && !c.includePartitioned {
+		return // never stored
+	}
+	if u := c.cookieURL(cookie); u != nil {
+		deleted := jarCookie(c.toHTTPCookie(cookie))
+		deleted.MaxAge = -1
+		c.Jar.SetCookies(u, []*http.Cookie{deleted})
+	}
+}
+
+// jarCookie returns cookie as it is stored in the jar. Chrome marks domain
+// cookies with a leading dot; any other cookie is host-only, which the jar
+// expects as an empty Domain so it is not sent to subdomains.
+func jarCookie(cookie *http.Cookie) *http.Cookie {
+	if strings.HasPrefix(cookie.Domain, ".") {
+		return cookie
+	}
+	hostOnly := *cookie
+	hostOnly.Domain = ""
+	return &hostOnly
+}
+
+// cookieURL returns the URL a CDP cookie is stored under in the jar, or nil
+// if the cookie has no domain and no default domain is configured
+func (c *client) cookieURL(cookie *Cookie) *url.URL {
+	// A leading dot marks a domain cookie; the jar gets that from the
+	// cookie's Domain (see jarCookie), the URL needs a valid host. Host-only
+	// cookies are stored under their exact host.
+	host := strings.TrimPrefix(cookie.Domain, ".")
+	if host == "" && c.defaultCookieDomain != nil {
+		// Host-only cookie without a domain; the jar keeps it host-only
+		// since the http.Cookie has no Domain either
+		host = c.defaultCookieDomain()
+	}
+	if host == "" {
+		return nil
+	}
+
+	return &url.URL{
+		Scheme: c.cookieScheme(cookie),
+		Host:   host,
+		Path:   cookiePath(cookie.Path),
+	}
+}
+
+// cookiePath returns path, or "/" if it is empty. Chrome reports the path
+// a cookie was set with; an empty one would otherwise make the jar derive a
+// default path from our synthetic URL (RFC 6265 section 5.1.4).
+func cookiePath(path string) string {
+	if path == "" {
+		return "/"
+	}
+	return path
+}
+
+// fallbackToCache returns nil if the cached cookies are still valid as
+// decided by CacheValid, notifying onStale, and err otherwise
+func (c *client) fallbackToCache(err error) error {
+	c.mu.Lock()
+	c.lastError = err
+	age := time.Since(c.lastRefresh)
+	onStale := c.onStale
+	c.mu.Unlock()
+	cacheValid := c.CacheValid()
+
+	c.logger.Warn("cookie refresh failed", "err", err, "cacheValid", cacheValid)
+	if !cacheValid {
+		return err
+	}
+	if onStale != nil {
+		onStale(age)
+	}
+	return nil // Use cached cookies
+}
+
+// DefaultContextCookies returns the cookies of Chrome's default browser
+// context, i.e. the regular (non-incognito) profile.
+func (c *client) DefaultContextCookies(ctx context.Context) ([]*http.Cookie, error) {
+	cdpClient, err := c.ensureConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	cookies, err := cdpClient.fetchContextCookies(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	return c.toHTTPCookies(cookies), nil
+}
+
+// RawCDPCookies returns the cookies of Chrome's default browser context as
+// reported by CDP, without converting them to http.Cookie.
+func (c *client) RawCDPCookies(ctx context.Context) ([]Cookie, error) {
+	cdpClient, err := c.ensureConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	cookies, err := cdpClient.fetchContextCookies(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	raw := make([]Cookie, len(cookies))
+	for i, cookie := range cookies {
+		raw[i] = *cookie
+	}
+	return raw, nil
+}
+
+// AllContextsCookies returns the cookies of the default browser context
+// followed by those of every other browser context (e.g. incognito windows
+// and contexts created via Target.createBrowserContext).
+func (c *client) AllContextsCookies(ctx context.Context) ([]*http.Cookie, error) {
+	cdpClient, err := c.ensureConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	contextIDs, err := cdpClient.fetchBrowserContexts(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var all []*http.Cookie
+	for _, id := range append([]string{""}, contextIDs...) {
+		cookies, err := cdpClient.fetchContextCookies(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, c.toHTTPCookies(cookies)...)
+	}
+	return all, nil
+}
+
+// IndexedDBValue returns the value stored under key in an IndexedDB object
+// store of origin, e.g. an auth token kept by a single-page app. Primitive
+// values are returned as JSON; objects as their string description.
+// IndexedDB is only available when connected to a page target.
+func (c *client) IndexedDBValue(ctx context.Context, origin, db, store, key string) ([]byte, error) {
+	cdpClient, err := c.ensureConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := cdpClient.fetchIndexedDBValue(ctx, origin, db, store, key)
+	if err != nil {
+		return nil, err
+	}
+	if len(value.Value) > 0 {
+		return value.Value, nil
+	}
+	return []byte(value.Description), nil
+}
+
+// PageCookies returns the cookies the page target the client is connected
+// to would send for its current URL, as reported by Network.getCookies.
+// This needs a connection to a page target, see WithPreferTarget.
+func (c *client) PageCookies(ctx context.Context) ([]*http.Cookie, error) {
+	cdpClient, err := c.ensureConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := cdpClient.fetchTargetInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if info.Type != "page" {
+		return nil, fmt.Errorf("connected to a %s target, not a page", info.Type)
+	}
+
+	cookies, err := cdpClient.fetchURLCookies(ctx, []string{info.URL})
+	if err != nil {
+		return nil, err
+	}
+	return c.toHTTPCookies(cookies), nil
+}
+
+// Execute sends an arbitrary CDP command, e.g. Runtime.evaluate, over the
+// client's connection to Chrome and returns its result. It connects first
+// if needed.
+func (c *client) Execute(ctx context.Context, method string, params any) (json.RawMessage, error) {
+	cdpClient, err := c.ensureConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return cdpClient.execute(ctx, method, params)
+}
+
+// Ping checks that Chrome is reachable and responsive by sending
+// Browser.getVersion, connecting first if needed. Unlike RefreshCookies it
+// leaves the cookies and user agent alone, e.g. for readiness probes.
+func (c *client) Ping(ctx context.Context) error {
+	cdpClient, err := c.ensureConnection(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = cdpClient.fetchVersion(ctx)
+	return err
+}
+
+// WaitForCookie polls Chrome's cookies until one named name for domain
+// exists and returns it, e.g. the session cookie after a login. An empty
+// domain matches any; a leading dot is ignored. Failures to reach Chrome
+// are retried until ctx is done. The poll interval is set with
+// WithCookiePollInterval. The jar is not updated.
+func (c *client) WaitForCookie(ctx context.Context, name, domain string) (*http.Cookie, error) {
+	domain = strings.TrimPrefix(domain, ".")
+	var lastErr error
+	for {
+		if c.closed.Load() {
+			return nil, ErrClosed
+		}
+		cdpClient, err := c.ensureConnection(ctx)
+		if err == nil {
+			var cookies []*Cookie
+			if cookies, err = cdpClient.fetchCookies(ctx); err == nil {
+				for _, cookie := range cookies {
+					if cookie.Name == name && (domain == "" || strings.TrimPrefix(cookie.Domain, ".") == domain) {
+						return c.toHTTPCookie(cookie), nil
+					}
+				}
+			} else {
+				c.disconnect()
+			}
+		}
+		if err != nil {
+			lastErr = err
+		}
+
+		if err := sleepContext(ctx, c.cookiePollInterval); err != nil {
+			if lastErr != nil {
+				return nil, fmt.Errorf("cookie %s not found: %w (last error: %v)", name, err, lastErr)
+			}
+			return nil, fmt.Errorf("cookie %s not found: %w", name, err)
+		}
+	}
+}
+
+// Navigate navigates the page target the client is connected to to u and
+// waits until the page has loaded or ctx is done, e.g. to warm up a session
+// before reading its cookies. This needs a connection to a page target, see
+// WithPreferTarget and WithTargetFilter.
+func (c *client) Navigate(ctx context.Context, u string) error {
+	cdpClient, err := c.ensureConnection(ctx)
+	if err != nil {
+		return err
+	}
+	return cdpClient.navigate(ctx, u)
+}
+
+// Evaluate evaluates the JavaScript expression expr in the page target the
+// client is connected to and returns its value as JSON, e.g. to read a
+// CSRF token from a page variable. Promises are awaited. When connected to
+// the browser endpoint, the first page target is attached to for the
+// evaluation. An exception thrown by expr is returned as an error.
+func (c *client) Evaluate(ctx context.Context, expr string) (json.RawMessage, error) {
+	cdpClient, err := c.ensureConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	info, err := cdpClient.fetchTargetInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if info.Type == "page" {
+		return cdpClient.evaluate(ctx, expr)
+	}
+
+	debugURL, err := c.endpointURL()
+	if err != nil {
+		return nil, err
+	}
+	wsURL, err := findTarget(ctx, &c.dialOpts, debugURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	page, err := dialWebSocket(ctx, wsURL, c.dialOpts)
+	if err != nil {
+		return nil, err
+	}
+	defer page.Close()
+	c.configure(page)
+	return page.evaluate(ctx, expr)
+}
+
+// CookiesForURL returns the cookies Chrome would send to u, as reported by
+// Network.getCookies. The browser endpoint has no Network domain; there the
+// cookies are fetched with Storage.getCookies and matched against u locally.
+func (c *client) CookiesForURL(ctx context.Context, u string) ([]*http.Cookie, error) {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return nil, err
+	}
+
+	cdpClient, err := c.ensureConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	cookies, err := cdpClient.fetchURLCookies(ctx, []string{u})
+	if err != nil {
+		all, ferr := cdpClient.fetchCookies(ctx)
+		if ferr != nil {
+			return nil, err
+		}
+		cookies = nil
+		for _, cookie := range all {
+			if cookieMismatch(cookie, parsed) == "" {
+				cookies = append(cookies, cookie)
+			}
+		}
+	}
+	return c.toHTTPCookies(cookies), nil
+}
+
+// LocalStorage returns the localStorage entries of securityOrigin, e.g.
+// "https://example.com", such as tokens a single-page app keeps outside of
+// cookies. DOMStorage is only available when connected to a page target.
+func (c *client) LocalStorage(ctx context.Context, securityOrigin string) (map[string]string, error) {
+	cdpClient, err := c.ensureConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := cdpClient.fetchLocalStorage(ctx, securityOrigin)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		if len(entry) == 2 {
+			items[entry[0]] = entry[1]
+		}
+	}
+	return items, nil
+}
+
+// PartitionedCookies returns the partitioned (CHIPS) cookies of Chrome's
+// default browser context whose partition key has the given top-level
+// site, e.g. "https://example.com".
+func (c *client) PartitionedCookies(ctx context.Context, topLevelSite string) ([]*http.Cookie, error) {
+	cdpClient, err := c.ensureConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	cookies, err := cdpClient.fetchCookies(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var partitioned []*Cookie
 	for _, cookie := range cookies {
-		c.Jar.SetCookies(&url.URL{
-			Scheme: "https",
-			Host:   cookie.Domain,
-			Path:   cookie.Path,
-		}, []*http.Cookie{
-			{
+		if cookie.PartitionKey != nil && cookie.PartitionKey.TopLevelSite == topLevelSite {
+			partitioned = append(partitioned, cookie)
+		}
+	}
+	return c.toHTTPCookies(partitioned), nil
+}
+
+// CookiesByRegistrableDomain returns the cookies of Chrome's default
+// browser context grouped by registrable domain (eTLD+1), like the
+// browser's cookie settings. Grouping needs the list set with
+// WithPublicSuffixList; without one ErrNoPublicSuffixList is returned.
+func (c *client) CookiesByRegistrableDomain(ctx context.Context) (map[string][]*http.Cookie, error) {
+	if c.psl == nil {
+		return nil, ErrNoPublicSuffixList
+	}
+	cookies, err := c.DefaultContextCookies(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	groups := make(map[string][]*http.Cookie)
+	for _, cookie := range cookies {
+		domain := registrableDomain(c.psl, cookie.Domain)
+		groups[domain] = append(groups[domain], cookie)
+	}
+	return groups, nil
+}
+
+// SetCookies pushes cookies into Chrome's default browser context. Each
+// cookie is sent with an explicit url derived from its domain, path and
+// Secure flag so that CDP accepts it, and keeps its expiry. Cookies without
+// a domain are not sent and are reported in a *CookiesRejectedError; see
+// SetCookiesForURL.
+func (c *client) SetCookies(ctx context.Context, cookies []*http.Cookie) error {
+	return c.setCookies(ctx, nil, cookies)
+}
+
+// SetCookiesForURL pushes cookies into Chrome's default browser context
+// like SetCookies, but sets cookies without a domain as host-only cookies
+// for u, e.g. cookies restored from a Cookie header.
+func (c *client) SetCookiesForURL(ctx context.Context, u string, cookies []*http.Cookie) error {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return err
+	}
+	if parsed.Host == "" {
+		return fmt.Errorf("url %q has no host", u)
+	}
+	return c.setCookies(ctx, parsed, cookies)
+}
+
+// setCookies pushes cookies into Chrome, deriving the url of cookies without
+// a domain from fallback if not nil
+func (c *client) setCookies(ctx context.Context, fallback *url.URL, cookies []*http.Cookie) error {
+	var params []*cookieParam
+	var rejected []*http.Cookie
+	for _, cookie := range cookies {
+		param := toCookieParam(cookie, fallback)
+		if param == nil {
+			rejected = append(rejected, cookie)
+			continue
+		}
+		params = append(params, param)
+	}
+
+	if len(params) > 0 {
+		cdpClient, err := c.ensureConnection(ctx)
+		if err != nil {
+			return err
+		}
+		if err := cdpClient.setCookies(ctx, params); err != nil {
+			return err
+		}
+	}
+
+	if len(rejected) > 0 {
+		return &CookiesRejectedError{Cookies: rejected}
+	}
+	return nil
+}
+
+// ClearCookies deletes all cookies of Chrome's default browser context and
+// empties the jar, including seeded and imported cookies. The next request
+// refreshes the cookies.
+func (c *client) ClearCookies(ctx context.Context) error {
+	cdpClient, err := c.ensureConnection(ctx)
+	if err != nil {
+		return err
+	}
+	if err := cdpClient.clearCookies(ctx); err != nil {
+		return err
+	}
+
+	c.jarMu.Lock()
+	defer c.jarMu.Unlock()
+	c.mu.Lock()
+	c.prevCookies = nil
+	c.imported = nil
+	c.lastRefresh = time.Time{}
+	c.mu.Unlock()
+	c.jar.reset()
+	return nil
+}
+
+// DeleteCookie deletes the cookies named name that would be sent to u from
+// Chrome and the jar. On the browser endpoint, which has no Network domain,
+// the matching cookies are overwritten with expired ones instead.
+func (c *client) DeleteCookie(ctx context.Context, name, u string) error {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return err
+	}
+
+	cdpClient, err := c.ensureConnection(ctx)
+	if err != nil {
+		return err
+	}
+
+	all, err := cdpClient.fetchCookies(ctx)
+	if err != nil {
+		return err
+	}
+	var matching []*Cookie
+	for _, cookie := range all {
+		if cookie.Name == name && cookieMismatch(cookie, parsed) == "" {
+			matching = append(matching, cookie)
+		}
+	}
+
+	if err := cdpClient.deleteCookies(ctx, name, u); err != nil {
+		var cdpErr *CDPError
+		if !errors.As(err, &cdpErr) {
+			return err
+		}
+		params := make([]*cookieParam, 0, len(matching))
+		for _, cookie := range matching {
+			param := &cookieParam{
 				Name:     cookie.Name,
-				Value:    cookie.Value,
-				Path:     cookie.Path,
-				Domain:   cookie.Domain,
+				Path:     cookiePath(cookie.Path),
 				Secure:   cookie.Secure,
-				HttpOnly: cookie.HTTPOnly,
-			},
-		})
+				HTTPOnly: cookie.HTTPOnly,
+				Expires:  1, // in the past
+			}
+			if strings.HasPrefix(cookie.Domain, ".") {
+				param.Domain = cookie.Domain
+			} else {
+				// Host-only cookie; a domain would make it a domain cookie
+				param.URL = (&url.URL{Scheme: "https", Host: cookie.Domain, Path: param.Path}).String()
+			}
+			params = append(params, param)
+		}
+		if len(params) > 0 {
+			if err := cdpClient.setCookies(ctx, params); err != nil {
+				return err
+			}
+		}
+	}
+
+	c.jarMu.Lock()
+	defer c.jarMu.Unlock()
+	c.mu.Lock()
+	for _, cookie := range matching {
+		delete(c.prevCookies, keyOf(cookie))
+		delete(c.imported, keyOf(cookie))
+	}
+	c.mu.Unlock()
+	for _, cookie := range matching {
+		c.removeCookie(cookie)
+	}
+	return nil
+}
+
+// toCookieParam converts an http.Cookie to a CDP cookie param, or returns
+// nil if the cookie has no domain to derive its url from and fallback is
+// nil. Cookies without a domain become host-only cookies of fallback.
+func toCookieParam(cookie *http.Cookie, fallback *url.URL) *cookieParam {
+	host := strings.TrimPrefix(cookie.Domain, ".")
+	if host == "" {
+		if fallback == nil {
+			return nil
+		}
+		host = fallback.Host
+	}
+
+	scheme := "http"
+	if cookie.Secure {
+		scheme = "https"
+	}
+	path := cookie.Path
+	if path == "" {
+		path = "/"
+	}
+
+	param := &cookieParam{
+		Name:     cookie.Name,
+		Value:    cookie.Value,
+		URL:      (&url.URL{Scheme: scheme, Host: host, Path: path}).String(),
+		Domain:   cookie.Domain,
+		Path:     path,
+		Secure:   cookie.Secure,
+		HTTPOnly: cookie.HttpOnly,
+	}
+	switch {
+	case cookie.MaxAge < 0:
+		param.Expires = 1 // in the past, deleting the cookie
+	case cookie.MaxAge > 0:
+		param.Expires = float64(time.Now().Add(time.Duration(cookie.MaxAge) * time.Second).Unix())
+	case !cookie.Expires.IsZero():
+		param.Expires = float64(cookie.Expires.Unix())
+	}
+	if cookie.Partitioned {
+		// http.Cookie doesn't say which top-level site partitions it;
+		// assume its own, as for a cookie set in a first-party context
+		param.PartitionKey = &CookiePartitionKey{TopLevelSite: "https://" + host}
+	}
+	return param
+}
+
+// toHTTPCookie converts a CDP cookie to an http.Cookie
+func (c *client) toHTTPCookie(cookie *Cookie) *http.Cookie {
+	result := &http.Cookie{
+		Name:        cookie.Name,
+		Value:       cookie.Value,
+		Path:        cookiePath(cookie.Path),
+		Domain:      cookie.Domain,
+		Secure:      cookie.Secure,
+		HttpOnly:    cookie.HTTPOnly,
+		Partitioned: cookie.PartitionKey != nil,
+		SameSite:    cookieSameSite(cookie.SameSite),
+	}
+	if !cookie.Session && cookie.Expires > 0 {
+		result.Expires = cookieExpiry(cookie.Expires)
+	} else if c.sessionCookieTTL > 0 {
+		result.Expires = time.Now().Add(c.sessionCookieTTL)
+	}
+	c.clampExpiry(result)
+	if !cookie.Session && cookie.Expires > 0 {
+		if result.MaxAge = int(time.Until(result.Expires) / time.Second); result.MaxAge <= 0 {
+			result.MaxAge = -1 // already expired
+		}
+	}
+	return result
+}
+
+// cookieSameSite maps a CDP SameSite value to http.SameSite
+func cookieSameSite(sameSite string) http.SameSite {
+	switch sameSite {
+	case "Strict":
+		return http.SameSiteStrictMode
+	case "Lax":
+		return http.SameSiteLaxMode
+	case "None":
+		return http.SameSiteNoneMode
+	}
+	return http.SameSiteDefaultMode
+}
+
+// maxCookieExpiry is the latest expiry cookies are given; Chrome reports
+// far-future expiries that overflow other representations
+var maxCookieExpiry = time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC)
+
+// cookieExpiry converts a CDP expiry in (possibly fractional) seconds since
+// the epoch to a time, clamped to maxCookieExpiry
+func cookieExpiry(expires float64) time.Time {
+	if expires >= float64(maxCookieExpiry.Unix()) {
+		return maxCookieExpiry
+	}
+	sec, frac := math.Modf(expires)
+	return time.Unix(int64(sec), int64(frac*1e9))
+}
+
+// clampExpiry limits the expiry of cookie to WithMaxExpiry
+func (c *client) clampExpiry(cookie *http.Cookie) {
+	if c.maxExpiry <= 0 || cookie.Expires.IsZero() {
+		return
+	}
+	if limit := time.Now().Add(c.maxExpiry); cookie.Expires.After(limit) {
+		cookie.Expires = limit
+	}
+}
+
+// toHTTPCookies converts CDP cookies to http.Cookies
+func (c *client) toHTTPCookies(cookies []*Cookie) []*http.Cookie {
+	result := make([]*http.Cookie, 0, len(cookies))
+	for _, cookie := range cookies {
+		result = append(result, c.toHTTPCookie(cookie))
+	}
+	return result
+}
+
+// cookieScheme returns the scheme a cookie is stored under in the jar
+func (c *client) cookieScheme(cookie *Cookie) string {
+	switch cookie.SourceScheme {
+	case "Secure":
+		return "https"
+	case "NonSecure":
+		return "http"
+	}
+	if cookie.Secure {
+		return "https"
+	}
+	return "http"
+}
+
+// seedCookies stores cookies in the jar and marks the cache as fresh.
+// Cookies without a domain cannot be scoped and are skipped.
+func (c *client) seedCookies(cookies []*http.Cookie) {
+	c.jarMu.Lock()
+	defer c.jarMu.Unlock()
+	var seeded []*Cookie
+	for _, cookie := range cookies {
+		if cookie.Domain == "" || c.cookieFilter != nil && !c.cookieFilter(cookie) {
+			continue
+		}
+		scheme := "http"
+		if cookie.Secure {
+			scheme = "https"
+		}
+		clamped := *cookie
+		c.clampExpiry(&clamped)
+		c.Jar.SetCookies(&url.URL{
+			Scheme: scheme,
+			Host:   strings.TrimPrefix(cookie.Domain, "."),
+			Path:   cookie.Path,
+		}, []*http.Cookie{&clamped})
+		seeded = append(seeded, seededCookie(&clamped))
 	}
 
 	c.mu.Lock()
+	c.addImported(seeded...)
 	c.lastRefresh = time.Now()
 	c.mu.Unlock()
+}
 
-	return nil
+// seededCookie converts a cookie stored by seedCookies to the CDP shape,
+// where domain cookies have a leading dot
+func seededCookie(cookie *http.Cookie) *Cookie {
+	seeded := &Cookie{
+		Name:     cookie.Name,
+		Value:    cookie.Value,
+		Domain:   "." + strings.TrimPrefix(cookie.Domain, "."),
+		Path:     cookiePath(cookie.Path),
+		HTTPOnly: cookie.HttpOnly,
+		Secure:   cookie.Secure,
+		Session:  true,
+		Expires:  -1,
+	}
+	switch {
+	case cookie.MaxAge > 0:
+		seeded.Session = false
+		seeded.Expires = float64(time.Now().Add(time.Duration(cookie.MaxAge) * time.Second).Unix())
+	case !cookie.Expires.IsZero():
+		seeded.Session = false
+		seeded.Expires = float64(cookie.Expires.Unix())
+	}
+	return seeded
+}
+
+// addImported records cookies seeded or imported into the jar so that
+// snapshots include them. c.mu must be held.
+func (c *client) addImported(cookies ...*Cookie) {
+	if c.imported == nil {
+		c.imported = make(map[cookieKey]*Cookie, len(cookies))
+	}
+	for _, cookie := range cookies {
+		c.imported[keyOf(cookie)] = cookie
+	}
+}
+
+// dropImported forgets imported cookies that a refresh replaced or removed
+// in the jar. c.mu must be held.
+func (c *client) dropImported(cookies map[cookieKey]*Cookie) {
+	for key := range cookies {
+		delete(c.imported, key)
+	}
+}
+
+// jarCookies returns the cookies in the jar: those of the last refresh and
+// the seeded or imported ones Chrome hasn't replaced. c.mu must be held.
+func (c *client) jarCookies() []*Cookie {
+	cookies := make([]*Cookie, 0, len(c.prevCookies)+len(c.imported))
+	for _, cookie := range c.prevCookies {
+		cookies = append(cookies, cookie)
+	}
+	for key, cookie := range c.imported {
+		if _, ok := c.prevCookies[key]; !ok {
+			cookies = append(cookies, cookie)
+		}
+	}
+	return cookies
+}
+
+// SnapshotCookies returns the cookies stored by the most recent refresh,
+// plus cookies seeded with WithInitialCookies or imported that Chrome
+// hasn't replaced, as a consistent view: a refresh or import is either
+// fully reflected or not at all.
+func (c *client) SnapshotCookies() []*http.Cookie {
+	c.jarMu.RLock()
+	defer c.jarMu.RUnlock()
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.toHTTPCookies(c.jarCookies())
+}
+
+// CookieHeader returns the Cookie header value the jar would send for u,
+// e.g. "name=value; name2=value2"
+func (c *client) CookieHeader(u *url.URL) string {
+	cookies := c.Jar.Cookies(u)
+	parts := make([]string, 0, len(cookies))
+	for _, cookie := range cookies {
+		parts = append(parts, cookie.Name+"="+cookie.Value)
+	}
+	return strings.Join(parts, "; ")
+}
+
+// Name returns the instance name set with WithName
+func (c *client) Name() string {
+	return c.name
 }
 
 // UserAgent returns the current user agent (may be empty if Chrome never connected)
 func (c *client) UserAgent() string {
+	if c.userAgentOverride != "" {
+		return c.userAgentOverride
+	}
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 	return c.userAgent
 }
 
-// CacheValid returns true if the cookie cache is still valid
-func (c *client) CacheValid() bool {
+// ProtocolVersion returns the CDP protocol version reported by Chrome, e.g.
+// "1.3" (empty if Chrome never connected)
+func (c *client) ProtocolVersion() string {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
-	return !c.lastRefresh.IsZero() && time.Since(c.lastRefresh) < c.cacheTTL
+	return c.protocolVersion
 }
 
-// Close closes the CDP connection
+// Pause stops the client from contacting Chrome without discarding its
+// state: requests are sent with the cookies already in the jar and
+// RefreshCookies returns ErrPaused until Resume is called.
+func (c *client) Pause() {
+	c.paused.Store(true)
+}
+
+// Resume undoes Pause
+func (c *client) Resume() {
+	c.paused.Store(false)
+}
+
+// Paused reports whether the client is paused
+func (c *client) Paused() bool {
+	return c.paused.Load()
+}
+
+// StartAutoRefresh refreshes the cookies every interval in the background
+// until ctx is cancelled, StopAutoRefresh is called or the client is closed,
+// so that requests rarely have to refresh inline. Refresh errors are
+// ignored; the next tick retries. Starting again replaces the running
+// refresh; an interval <= 0 only stops it.
+func (c *client) StartAutoRefresh(ctx context.Context, interval time.Duration) {
+	c.autoRefreshMu.Lock()
+	defer c.autoRefreshMu.Unlock()
+	c.stopAutoRefreshLocked()
+	if interval <= 0 {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	c.autoRefreshCancel = cancel
+	c.autoRefreshDone = done
+
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-c.closeCtx.Done():
+				return
+			case <-ticker.C:
+				if !c.Paused() {
+					c.RefreshCookies(ctx)
+				}
+			}
+		}
+	}()
+}
+
+// StopAutoRefresh stops the refresh started by StartAutoRefresh and waits
+// for it to exit. It is a no-op if none is running.
+func (c *client) StopAutoRefresh() {
+	c.autoRefreshMu.Lock()
+	defer c.autoRefreshMu.Unlock()
+	c.stopAutoRefreshLocked()
+}
+
+// stopAutoRefreshLocked stops the background refresh, if any.
+// autoRefreshMu must be held.
+func (c *client) stopAutoRefreshLocked() {
+	if c.autoRefreshCancel != nil {
+		c.autoRefreshCancel()
+		<-c.autoRefreshDone
+		c.autoRefreshCancel, c.autoRefreshDone = nil, nil
+	}
+}
+
+// CacheValid returns true if the cookie cache is still valid, as decided by
+// the WithCacheValidator function or else the cache TTL
+func (c *client) CacheValid() bool {
+	if c.cacheValidator == nil {
+		c.mu.RLock()
+		lastRefresh := c.lastRefresh
+		c.mu.RUnlock()
+		return !lastRefresh.IsZero() && time.Since(lastRefresh) < c.cacheTTL
+	}
+
+	// Snapshot the refresh and its cookies together, then call the
+	// validator without holding locks since it may use the client
+	c.jarMu.RLock()
+	c.mu.RLock()
+	lastRefresh := c.lastRefresh
+	cookies := c.jarCookies()
+	c.mu.RUnlock()
+	c.jarMu.RUnlock()
+	return c.cacheValidator(lastRefresh, c.toHTTPCookies(cookies))
+}
+
+// needsRefresh reports whether the cookies should be refreshed before the
+// next request: the cache or the session cookies expired, or the
+// connection was re-established
+func (c *client) needsRefresh() bool {
+	if c.sessionCookieTTL > 0 {
+		c.mu.RLock()
+		expired := time.Since(c.lastRefresh) >= c.sessionCookieTTL
+		c.mu.RUnlock()
+		if expired {
+			return true
+		}
+	}
+	return !c.CacheValid() || c.reconcile.Load()
+}
+
+// Close closes the CDP connection. In-flight refreshes are cancelled and
+// fail with ErrClosed, as does any later use of the client.
 func (c *client) Close() error {
-	c.disconnect()
-	return nil
+	ctx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+	defer cancel()
+	return c.CloseContext(ctx)
+}
+
+// CloseContext is like Close, but waits for the connection to shut down
+// only until ctx ends.
+func (c *client) CloseContext(ctx context.Context) error {
+	c.closed.Store(true)
+	c.closeCancel(ErrClosed)
+	c.StopAutoRefresh()
+
+	c.mu.Lock()
+	cdpClient := c.cdpClient
+	c.cdpClient = nil
+	c.mu.Unlock()
+
+	if cdpClient == nil {
+		return nil
+	}
+	return cdpClient.CloseContext(ctx)
+}
+
+// Extractor keeps a cookie jar in sync with Chrome without wrapping an
+// http.Client. Call RefreshCookies on your own schedule and use Jar with any
+// client, or Client for one that refreshes the cookies as needed.
+type Extractor struct {
+	*client
+}
+
+// NewExtractor creates an Extractor. Like NewClient, it always succeeds and
+// connects to Chrome lazily on the first refresh.
+func NewExtractor(debugURL string, opts ...Option) *Extractor {
+	return &Extractor{newClient(debugURL, 0, opts...)}
+}
+
+// Client returns an http.Client that injects the Extractor's cookies like
+// one from NewClient, sending requests through base (the transport set with
+// WithBaseTransport, or http.DefaultTransport, if nil). Pausing, closing or
+// auto-refreshing the Extractor applies to its requests.
+func (e *Extractor) Client(base http.RoundTripper) *http.Client {
+	return e.httpClient(base)
 }
 
 // newClient creates a new Client (internal)
-func newClient(debugURL string, cacheTTL time.Duration) *client {
+func newClient(debugURL string, cacheTTL time.Duration, opts ...Option) *client {
 	if debugURL == "" {
 		debugURL = "ws://localhost:9222"
 	}
@@ -183,11 +1520,68 @@ func newClient(debugURL string, cacheTTL time.Duration) *client {
 		cacheTTL = 5 * time.Minute
 	}
 
-	jar, _ := cookiejar.New(nil)
-
-	return &client{
-		debugURL: debugURL,
-		Jar:      jar,
-		cacheTTL: cacheTTL,
+	c := &client{
+		debugURL:             debugURL,
+		cacheTTL:             cacheTTL,
+		includePartitioned:   true,
+		reconcileOnReconnect: true,
+		backoff:              defaultBackoff,
+		maxReconnects:        1,
+		connectRetries:       2,
+		commandTimeout:       defaultCommandTimeout,
+		cookiePollInterval:   250 * time.Millisecond,
+		buildUserAgent:       func(version BrowserVersion) string { return version.UserAgent },
+	}
+	c.logger = discardLogger
+	c.closeCtx, c.closeCancel = context.WithCancelCause(context.Background())
+	c.dialFunc = func(ctx context.Context, debugURL string) (*cdpClient, error) {
+		if c.directWebSocket && c.webSocketURL != "" {
+			return dialWebSocket(ctx, debugURL, c.dialOpts)
+		}
+		if c.targetFilter != nil {
+			wsURL, err := findTarget(ctx, &c.dialOpts, debugURL, c.targetFilter)
+			if err != nil {
+				return nil, err
+			}
+			return dialWebSocket(ctx, wsURL, c.dialOpts)
+		}
+		if c.preferTarget {
+			if wsURL, err := findTarget(ctx, &c.dialOpts, debugURL, nil); err == nil {
+				return dialWebSocket(ctx, wsURL, c.dialOpts)
+			}
+		}
+		return dialCDPClient(ctx, debugURL, c.dialOpts)
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.recorder != nil && c.recorder.w == nil {
+		c.recorder = nil
+	}
+	if c.recorder != nil {
+		c.recorder.name = c.name
+	}
+	if c.name != "" {
+		c.logger = c.logger.With("client", c.name)
+	}
+	if (c.dialOpts.dialContext != nil || c.dialOpts.tlsConfig != nil) && c.dialOpts.httpClient == nil {
+		c.dialOpts.httpClient = newDebugHTTPClient(c.dialOpts.dialContext, c.dialOpts.tlsConfig)
+	}
+	c.jar = newResettableJar(func() http.CookieJar {
+		var jar http.CookieJar
+		if c.shardJar {
+			jar = newShardedJar(c.psl)
+		} else {
+			jar, _ = cookiejar.New(&cookiejar.Options{PublicSuffixList: c.psl})
+		}
+		if c.allowSingleLabel {
+			jar = newSingleLabelJar(jar)
+		}
+		return jar
+	})
+	c.Jar = c.jar
+	if len(c.initialCookies) > 0 {
+		c.seedCookies(c.initialCookies)
 	}
+	return c
 }
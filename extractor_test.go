@@ -0,0 +1,3381 @@
+package cdphttp
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// errDropConnection makes fakeChrome close the websocket without a close
+// handshake instead of answering, like a killed browser
+var errDropConnection = errors.New("drop connection")
+
+// fakeChrome is a minimal CDP endpoint serving /json/version, /json/list
+// and websockets that answer commands from handlers.
+type fakeChrome struct {
+	*httptest.Server
+	handlers    map[string]func(params json.RawMessage) (any, error)
+	compression websocket.CompressionMode
+	targets     []Target
+	origins     []string                    // allowed websocket origins, like --remote-allow-origins
+	wrap        func(message []byte) []byte // wraps outgoing messages, e.g. in a proxy envelope
+
+	lastPath atomic.Value // path of the last websocket connection
+}
+
+func newFakeChrome(t *testing.T, handlers map[string]func(params json.RawMessage) (any, error)) *fakeChrome {
+	t.Helper()
+	f := &fakeChrome{handlers: handlers}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// debugURL returns the ws:// debug URL clients should connect to
+func (f *fakeChrome) debugURL() string {
+	return "ws" + strings.TrimPrefix(f.URL, "http")
+}
+
+func (f *fakeChrome) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/json/version" {
+		json.NewEncoder(w).Encode(map[string]string{
+			"webSocketDebuggerUrl": f.debugURL() + "/devtools/browser/fake",
+		})
+		return
+	}
+	if r.URL.Path == "/json/list" {
+		json.NewEncoder(w).Encode(f.targets)
+		return
+	}
+
+	f.lastPath.Store(r.URL.Path)
+	conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{CompressionMode: f.compression, OriginPatterns: f.origins})
+	if err != nil {
+		return
+	}
+	defer conn.CloseNow()
+
+	ctx := r.Context()
+	write := func(message []byte) error {
+		if f.wrap != nil {
+			message = f.wrap(message)
+		}
+		return conn.Write(ctx, websocket.MessageText, message)
+	}
+	for {
+		_, data, err := conn.Read(ctx)
+		if err != nil {
+			return
+		}
+		var req struct {
+			ID     int64           `json:"id"`
+			Method string          `json:"method"`
+			Params json.RawMessage `json:"params"`
+		}
+		if err := json.Unmarshal(data, &req); err != nil {
+			return
+		}
+
+		resp := map[string]any{"id": req.ID}
+		var events []fakeEvent
+		handler, ok := f.handlers[req.Method]
+		if !ok {
+			resp["error"] = map[string]any{"code": -32601, "message": "'" + req.Method + "' wasn't found"}
+		} else if result, err := handler(req.Params); errors.Is(err, errDropConnection) {
+			return
+		} else if cdpErr := (*CDPError)(nil); errors.As(err, &cdpErr) {
+			resp["error"] = map[string]any{"code": cdpErr.Code, "message": cdpErr.Message}
+		} else if err != nil {
+			resp["error"] = map[string]any{"code": -32000, "message": err.Error()}
+		} else if withEvents, ok := result.(fakeResultWithEvents); ok {
+			resp["result"] = withEvents.Result
+			events = withEvents.Events
+		} else if raw, ok := result.(fakeRawResult); ok {
+			if err := write(fmt.Appendf(nil, `{"id":%d,"result":%s}`, req.ID, raw)); err != nil {
+				return
+			}
+			continue
+		} else {
+			resp["result"] = result
+		}
+		if err := write(mustMarshal(resp)); err != nil {
+			return
+		}
+		for _, event := range events {
+			if err := write(mustMarshal(event)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// fakeResultWithEvents is returned by handlers to emit events after the
+// response
+type fakeResultWithEvents struct {
+	Result any
+	Events []fakeEvent
+}
+
+// fakeRawResult is returned by handlers to send a result verbatim, e.g.
+// the invalid JSON some Chromium forks emit
+type fakeRawResult string
+
+// fakeEvent is a CDP event
+type fakeEvent struct {
+	Method string `json:"method"`
+	Params any    `json:"params"`
+}
+
+// cookieHandlers answers Storage.getCookies and Browser.getVersion
+func cookieHandlers(cookies ...*Cookie) map[string]func(json.RawMessage) (any, error) {
+	return map[string]func(json.RawMessage) (any, error){
+		"Storage.getCookies": func(json.RawMessage) (any, error) {
+			return getCookiesResponses{Cookies: cookies}, nil
+		},
+		"Browser.getVersion": func(json.RawMessage) (any, error) {
+			return BrowserVersion{UserAgent: "FakeChrome/1.0"}, nil
+		},
+	}
+}
+
+func TestRefreshCookiesRecoversAfterDialFailures(t *testing.T) {
+	chrome := newFakeChrome(t, cookieHandlers(&Cookie{Name: "sid", Value: "abc", Domain: "example.com", Path: "/", SourceScheme: "Secure"}))
+
+	var failures atomic.Int64
+	failures.Store(2)
+	c := newClient(chrome.debugURL(), 0, WithConnectRetries(0))
+	c.dialFunc = func(ctx context.Context, debugURL string) (*cdpClient, error) {
+		if failures.Add(-1) >= 0 {
+			return nil, errors.New("dial refused")
+		}
+		return createCDPClient(ctx, debugURL)
+	}
+	defer c.Close()
+
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if err := c.RefreshCookies(ctx); !errors.Is(err, ErrChromeUnavailable) {
+			t.Fatalf("attempt %d: got %v, want ErrChromeUnavailable", i, err)
+		}
+	}
+	if err := c.RefreshCookies(ctx); err != nil {
+		t.Fatalf("RefreshCookies after recovery: %v", err)
+	}
+
+	cookies := c.Jar.Cookies(&url.URL{Scheme: "https", Host: "example.com", Path: "/"})
+	if len(cookies) != 1 || cookies[0].Value != "abc" {
+		t.Fatalf("jar cookies = %v, want sid=abc", cookies)
+	}
+	if ua := c.UserAgent(); ua != "FakeChrome/1.0" {
+		t.Fatalf("UserAgent = %q", ua)
+	}
+}
+
+func TestAbnormalClosureReconnects(t *testing.T) {
+	var drop atomic.Bool
+	handlers := cookieHandlers(&Cookie{Name: "sid", Value: "abc", Domain: "example.com", Path: "/"})
+	getCookies := handlers["Storage.getCookies"]
+	handlers["Storage.getCookies"] = func(params json.RawMessage) (any, error) {
+		if drop.Load() {
+			return nil, errDropConnection
+		}
+		return getCookies(params)
+	}
+	chrome := newFakeChrome(t, handlers)
+
+	c := newClient(chrome.debugURL(), 0)
+	defer c.Close()
+
+	ctx := context.Background()
+	first, _ := c.ensureConnection(ctx)
+	drop.Store(true)
+	if _, err := first.fetchCookies(ctx); err == nil {
+		t.Fatal("fetchCookies on dropped connection succeeded")
+	}
+	if !first.dead.Load() {
+		t.Fatal("connection not marked dead after abnormal closure")
+	}
+
+	drop.Store(false)
+	second, _ := c.ensureConnection(ctx)
+	if second == nil || second == first {
+		t.Fatal("ensureConnection did not replace dead connection")
+	}
+	if _, err := second.fetchCookies(ctx); err != nil {
+		t.Fatalf("fetchCookies after reconnect: %v", err)
+	}
+}
+
+func TestEmptyPathCookieDefaultsToRoot(t *testing.T) {
+	chrome := newFakeChrome(t, cookieHandlers(&Cookie{Name: "sid", Value: "abc", Domain: "example.com", Path: ""}))
+
+	c := newClient(chrome.debugURL(), 0)
+	defer c.Close()
+
+	if err := c.RefreshCookies(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"/", "/a", "/a/b/c"} {
+		cookies := c.Jar.Cookies(&url.URL{Scheme: "https", Host: "example.com", Path: path})
+		if len(cookies) != 1 || cookies[0].Name != "sid" {
+			t.Errorf("path %q: jar cookies = %v, want sid", path, cookies)
+		}
+	}
+
+	exported, err := c.DefaultContextCookies(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exported) != 1 || exported[0].Path != "/" {
+		t.Fatalf("exported cookies = %v, want path /", exported)
+	}
+}
+
+func TestAcceptEncodingDecodesGzip(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Accept-Encoding"); got != ChromeAcceptEncoding {
+			t.Errorf("Accept-Encoding = %q", got)
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		zw := gzip.NewWriter(w)
+		zw.Write([]byte("hello"))
+		zw.Close()
+	}))
+	defer srv.Close()
+
+	cli := NewClient("ws://127.0.0.1:1", WithAcceptEncoding(ChromeAcceptEncoding), WithInitialCookies([]*http.Cookie{{Name: "a", Value: "b", Domain: "example.com"}}))
+	resp, err := cli.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "hello" || resp.Header.Get("Content-Encoding") != "" {
+		t.Fatalf("body = %q, Content-Encoding = %q", body, resp.Header.Get("Content-Encoding"))
+	}
+}
+
+func TestAcceptEncodingReusedRequest(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		zw := gzip.NewWriter(w)
+		zw.Write([]byte("hello"))
+		zw.Close()
+	}))
+	defer srv.Close()
+
+	cli := NewClient("ws://127.0.0.1:1", WithAcceptEncoding(ChromeAcceptEncoding), WithInitialCookies([]*http.Cookie{{Name: "a", Value: "b", Domain: "example.com"}}))
+	req, err := http.NewRequest("GET", srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 2 {
+		resp, err := cli.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != "hello" {
+			t.Fatalf("send %d: body = %q, Content-Encoding = %q", i+1, body, resp.Header.Get("Content-Encoding"))
+		}
+	}
+	if got := req.Header.Get("Accept-Encoding"); got != "" {
+		t.Errorf("caller's request modified: Accept-Encoding = %q", got)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	chrome := newFakeChrome(t, cookieHandlers())
+
+	c := newClient(chrome.debugURL(), 0)
+	report, err := c.Validate(context.Background())
+	if err != nil || !report.OK() {
+		t.Fatalf("Validate: %v\n%s", err, report)
+	}
+	if len(report.Checks) != 5 {
+		t.Fatalf("got %d checks, want 5:\n%s", len(report.Checks), report)
+	}
+	if c.cdpClient != nil {
+		t.Fatal("Validate used the client's connection")
+	}
+}
+
+func TestCompressedLargeCookiePayload(t *testing.T) {
+	cookies := make([]*Cookie, 20000)
+	for i := range cookies {
+		cookies[i] = &Cookie{
+			Name:   fmt.Sprintf("cookie%05d", i),
+			Value:  strings.Repeat("v", 64),
+			Domain: fmt.Sprintf("site%d.example.com", i%100),
+			Path:   "/",
+		}
+	}
+	chrome := newFakeChrome(t, cookieHandlers(cookies...))
+	chrome.compression = websocket.CompressionContextTakeover
+	payload := len(mustMarshal(getCookiesResponses{Cookies: cookies}))
+
+	c := newClient(chrome.debugURL(), 0, WithCompression(websocket.CompressionContextTakeover))
+	defer c.Close()
+
+	got, err := c.DefaultContextCookies(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(cookies) {
+		t.Fatalf("got %d cookies, want %d", len(got), len(cookies))
+	}
+
+	// The limit applies to the decompressed message, even though the
+	// compressed payload would fit
+	small := newClient(chrome.debugURL(), 0, WithCompression(websocket.CompressionContextTakeover), WithReadLimit(int64(payload/2)))
+	defer small.Close()
+
+	_, err = small.DefaultContextCookies(context.Background())
+	if !errors.Is(err, websocket.ErrMessageTooBig) || !strings.Contains(err.Error(), "read limit") {
+		t.Fatalf("got %v, want read limit error", err)
+	}
+}
+
+func TestReadLimit(t *testing.T) {
+	chrome := newFakeChrome(t, cookieHandlers(&Cookie{Name: "sid", Value: strings.Repeat("v", 4096), Domain: "example.com", Path: "/"}))
+
+	for _, tt := range []struct {
+		limit   int64
+		wantErr bool
+	}{{1024, true}, {-1, false}} {
+		c := newClient(chrome.debugURL(), 0, WithReadLimit(tt.limit))
+		_, err := c.DefaultContextCookies(context.Background())
+		if tt.wantErr != errors.Is(err, websocket.ErrMessageTooBig) {
+			t.Errorf("limit %d: error = %v", tt.limit, err)
+		}
+		c.Close()
+	}
+}
+
+func TestEmptyDomainCookie(t *testing.T) {
+	chrome := newFakeChrome(t, cookieHandlers(
+		&Cookie{Name: "hostonly", Value: "1", Path: "/"},
+		&Cookie{Name: "sid", Value: "abc", Domain: "other.com", Path: "/"},
+	))
+
+	// Without a default domain the cookie is skipped rather than stored
+	// under an empty host
+	c := newClient(chrome.debugURL(), 0)
+	defer c.Close()
+	if err := c.RefreshCookies(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.CookieHeader(&url.URL{Scheme: "https", Host: "other.com", Path: "/"}); got != "sid=abc" {
+		t.Fatalf("CookieHeader = %q, want sid=abc", got)
+	}
+
+	c = newClient(chrome.debugURL(), 0, WithDefaultCookieDomain(func() string { return "app.example.com" }))
+	defer c.Close()
+	if err := c.RefreshCookies(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.CookieHeader(&url.URL{Scheme: "https", Host: "app.example.com", Path: "/"}); got != "hostonly=1" {
+		t.Fatalf("CookieHeader(app.example.com) = %q, want hostonly=1", got)
+	}
+	if got := c.CookieHeader(&url.URL{Scheme: "https", Host: "sub.app.example.com", Path: "/"}); got != "" {
+		t.Fatalf("CookieHeader(sub.app.example.com) = %q, want host-only cookie not sent", got)
+	}
+}
+
+func TestAwaitConnection(t *testing.T) {
+	chrome := newFakeChrome(t, cookieHandlers())
+
+	var failures atomic.Int64
+	failures.Store(3)
+	c := newClient(chrome.debugURL(), 0, WithBackoff(ConstantBackoff(time.Millisecond)))
+	c.dialFunc = func(ctx context.Context, debugURL string) (*cdpClient, error) {
+		if failures.Add(-1) >= 0 {
+			return nil, errors.New("dial refused")
+		}
+		return createCDPClient(ctx, debugURL)
+	}
+	defer c.Close()
+
+	if attempts, err := c.AwaitConnection(context.Background(), 2); err == nil || attempts != 2 {
+		t.Fatalf("AwaitConnection(2) = %d, %v; want 2 failed attempts", attempts, err)
+	}
+	if attempts, err := c.AwaitConnection(context.Background(), 0); err != nil || attempts != 2 {
+		t.Fatalf("AwaitConnection(0) = %d, %v; want success after 2 attempts", attempts, err)
+	}
+}
+
+func TestRawCDPCookiesKeepsAllFields(t *testing.T) {
+	want := Cookie{
+		Name: "sid", Value: "abc", Domain: "example.com", Path: "/",
+		SameSite: "Lax", Priority: "High", SourceScheme: "Secure", SourcePort: 443,
+		PartitionKey: &CookiePartitionKey{TopLevelSite: "https://example.com", HasCrossSiteAncestor: true},
+	}
+	chrome := newFakeChrome(t, cookieHandlers(&want))
+
+	c := newClient(chrome.debugURL(), 0)
+	defer c.Close()
+
+	got, err := c.RawCDPCookies(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || !reflect.DeepEqual(got[0], want) {
+		t.Fatalf("RawCDPCookies = %+v, want %+v", got, want)
+	}
+}
+
+func TestCloseDuringRoundTrip(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handlers := cookieHandlers(&Cookie{Name: "sid", Value: "abc", Domain: "example.com", Path: "/"})
+	handlers["Storage.getCookies"] = func(json.RawMessage) (any, error) {
+		close(started)
+		<-release
+		return nil, errDropConnection
+	}
+	chrome := newFakeChrome(t, handlers)
+
+	c := NewExtractor(chrome.debugURL())
+	hc := c.Client(nil)
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := hc.Get("https://example.com/")
+		errc <- err
+	}()
+
+	<-started
+	closed := make(chan struct{})
+	go func() {
+		c.Close()
+		close(closed)
+	}()
+	err := <-errc
+	close(release) // let Chrome answer the close handshake
+	<-closed
+	if !errors.Is(err, ErrClosed) {
+		t.Fatalf("in-flight RoundTrip error = %v, want ErrClosed", err)
+	}
+	if _, err := hc.Get("https://example.com/"); !errors.Is(err, ErrClosed) {
+		t.Fatalf("RoundTrip after Close error = %v, want ErrClosed", err)
+	}
+	if c.cdpClient != nil {
+		t.Fatal("reconnected after Close")
+	}
+}
+
+func TestAllowSingleLabelDomains(t *testing.T) {
+	chrome := newFakeChrome(t, cookieHandlers(&Cookie{Name: "sid", Value: "abc", Domain: ".intranet", Path: "/", SourceScheme: "NonSecure"}))
+
+	for _, allow := range []bool{false, true} {
+		c := newClient(chrome.debugURL(), 0, WithAllowSingleLabelDomains(allow))
+		if err := c.RefreshCookies(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+
+		if got := c.Jar.Cookies(&url.URL{Scheme: "http", Host: "intranet", Path: "/"}); len(got) != 1 {
+			t.Errorf("allow=%v: intranet cookies = %v, want sid", allow, got)
+		}
+		got := c.Jar.Cookies(&url.URL{Scheme: "http", Host: "wiki.intranet", Path: "/"})
+		if allow != (len(got) == 1) {
+			t.Errorf("allow=%v: wiki.intranet cookies = %v", allow, got)
+		}
+	}
+}
+
+func TestOnUserAgentChange(t *testing.T) {
+	var version atomic.Int64
+	handlers := cookieHandlers()
+	handlers["Browser.getVersion"] = func(json.RawMessage) (any, error) {
+		return BrowserVersion{UserAgent: fmt.Sprintf("FakeChrome/%d.0", version.Load())}, nil
+	}
+	chrome := newFakeChrome(t, handlers)
+
+	var changes []string
+	c := newClient(chrome.debugURL(), 0, WithOnUserAgentChange(func(old, new string) {
+		changes = append(changes, old+" -> "+new)
+	}))
+	defer c.Close()
+
+	for _, v := range []int64{1, 1, 2} {
+		version.Store(v)
+		if err := c.RefreshCookies(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(changes) != 1 || changes[0] != "FakeChrome/1.0 -> FakeChrome/2.0" {
+		t.Fatalf("changes = %q", changes)
+	}
+	if ua := c.UserAgent(); ua != "FakeChrome/2.0" {
+		t.Fatalf("UserAgent = %q, want FakeChrome/2.0", ua)
+	}
+}
+
+func TestUserAgentRefresh(t *testing.T) {
+	var version atomic.Int64
+	handlers := cookieHandlers()
+	handlers["Browser.getVersion"] = func(json.RawMessage) (any, error) {
+		if version.Load() == 0 {
+			return nil, errors.New("unavailable")
+		}
+		return BrowserVersion{UserAgent: fmt.Sprintf("FakeChrome/%d.0", version.Load())}, nil
+	}
+	chrome := newFakeChrome(t, handlers)
+
+	refresh := func(c *client, v int64) string {
+		t.Helper()
+		version.Store(v)
+		if err := c.RefreshCookies(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		return c.UserAgent()
+	}
+
+	c := newClient(chrome.debugURL(), 0)
+	defer c.Close()
+	refresh(c, 1)
+	if ua := refresh(c, 2); ua != "FakeChrome/1.0" {
+		t.Fatalf("UserAgent = %q, want FakeChrome/1.0 until reconnecting", ua)
+	}
+	c.disconnect()
+	if ua := refresh(c, 2); ua != "FakeChrome/2.0" {
+		t.Fatalf("UserAgent = %q after reconnecting, want FakeChrome/2.0", ua)
+	}
+
+	c = newClient(chrome.debugURL(), 0, WithUserAgentRefresh(time.Nanosecond))
+	defer c.Close()
+	refresh(c, 1)
+	if ua := refresh(c, 2); ua != "FakeChrome/2.0" {
+		t.Fatalf("UserAgent = %q, want FakeChrome/2.0", ua)
+	}
+	if ua := refresh(c, 0); ua != "FakeChrome/2.0" {
+		t.Fatalf("UserAgent = %q after a failed fetch, want FakeChrome/2.0", ua)
+	}
+}
+
+func TestPageCookies(t *testing.T) {
+	handlers := cookieHandlers()
+	handlers["Target.getTargetInfo"] = func(json.RawMessage) (any, error) {
+		return getTargetInfoResponse{TargetInfo: targetInfo{TargetID: "1", Type: "page", URL: "https://example.com/app"}}, nil
+	}
+	handlers["Network.getCookies"] = func(params json.RawMessage) (any, error) {
+		var p struct {
+			URLs []string `json:"urls"`
+		}
+		json.Unmarshal(params, &p)
+		if len(p.URLs) != 1 || p.URLs[0] != "https://example.com/app" {
+			return nil, fmt.Errorf("unexpected urls %q", p.URLs)
+		}
+		return getCookiesResponses{Cookies: []*Cookie{{Name: "sid", Value: "abc", Domain: "example.com", Path: "/"}}}, nil
+	}
+	chrome := newFakeChrome(t, handlers)
+
+	c := newClient(chrome.debugURL(), 0)
+	defer c.Close()
+
+	cookies, err := c.PageCookies(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cookies) != 1 || cookies[0].Name != "sid" {
+		t.Fatalf("PageCookies = %v, want sid", cookies)
+	}
+}
+
+func TestHostOnlyCookie(t *testing.T) {
+	chrome := newFakeChrome(t, cookieHandlers(
+		&Cookie{Name: "host", Value: "only", Domain: "example.com", Path: "/"},
+		&Cookie{Name: "sid", Value: "abc", Domain: ".example.com", Path: "/"},
+	))
+
+	for _, sharded := range []bool{false, true} {
+		var opts []Option
+		if sharded {
+			opts = append(opts, WithShardedJar())
+		}
+		c := newClient(chrome.debugURL(), 0, opts...)
+		if err := c.RefreshCookies(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		for host, want := range map[string]string{
+			"example.com":     "host=only; sid=abc",
+			"sub.example.com": "sid=abc",
+		} {
+			parts := strings.Split(c.CookieHeader(&url.URL{Scheme: "https", Host: host, Path: "/"}), "; ")
+			slices.Sort(parts)
+			if got := strings.Join(parts, "; "); got != want {
+				t.Errorf("sharded %v: cookies for %s = %q, want %q", sharded, host, got, want)
+			}
+		}
+		c.Close()
+	}
+}
+
+func TestImportChromeExtensionJSON(t *testing.T) {
+	c := newClient("ws://127.0.0.1:1", 0)
+	defer c.Close()
+
+	export := `[
+		{"domain": ".example.com", "expirationDate": 4102444800.5, "hostOnly": false, "httpOnly": true,
+		 "name": "sid", "path": "/", "sameSite": "lax", "secure": true, "session": false, "storeId": "0", "value": "abc"},
+		{"domain": "example.com", "hostOnly": true, "name": "tmp", "path": "/", "sameSite": "unspecified",
+		 "secure": false, "session": true, "storeId": "0", "value": "1"}
+	]`
+	if err := c.ImportChromeExtensionJSON(strings.NewReader(export)); err != nil {
+		t.Fatal(err)
+	}
+	if !c.CacheValid() {
+		t.Fatal("cache not valid after import")
+	}
+
+	for host, want := range map[string]string{
+		"example.com":     "sid=abc; tmp=1",
+		"sub.example.com": "sid=abc",
+	} {
+		parts := strings.Split(c.CookieHeader(&url.URL{Scheme: "https", Host: host, Path: "/"}), "; ")
+		slices.Sort(parts)
+		if got := strings.Join(parts, "; "); got != want {
+			t.Errorf("cookies for %s = %q, want %q", host, got, want)
+		}
+	}
+}
+
+// roundTripFunc adapts a function to http.RoundTripper
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func TestNewClientOptions(t *testing.T) {
+	var got *http.Request
+	base := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		got = req
+		return &http.Response{StatusCode: http.StatusNoContent, Body: http.NoBody, Request: req}, nil
+	})
+
+	hc := NewClient("ws://127.0.0.1:1",
+		WithCacheTTL(time.Hour),
+		WithBaseTransport(base),
+		WithUserAgentOverride("Custom/1.0"),
+		WithInitialCookies([]*http.Cookie{{Name: "sid", Value: "abc", Domain: "example.com", Path: "/"}}),
+	)
+	if _, err := hc.Get("https://example.com/"); err != nil {
+		t.Fatal(err)
+	}
+	if ua := got.Header.Get("User-Agent"); ua != "Custom/1.0" {
+		t.Errorf("User-Agent = %q, want Custom/1.0", ua)
+	}
+	if cookie := got.Header.Get("Cookie"); cookie != "sid=abc" {
+		t.Errorf("Cookie = %q, want sid=abc", cookie)
+	}
+	if ttl := hc.Transport.(*roundTripper).client.cacheTTL; ttl != time.Hour {
+		t.Errorf("cache TTL = %v, want 1h", ttl)
+	}
+}
+
+func TestCookieDebugMatchesJar(t *testing.T) {
+	chrome := newFakeChrome(t, cookieHandlers(
+		&Cookie{Name: "sid", Value: "abc", Domain: ".example.com", Path: "/"},
+		&Cookie{Name: "host", Value: "1", Domain: "example.com", Path: "/"},
+		&Cookie{Name: "chips", Value: "2", Domain: ".example.com", Path: "/", Secure: true,
+			PartitionKey: &CookiePartitionKey{TopLevelSite: "https://example.com"}},
+		&Cookie{Name: "tracker", Value: "3", Domain: ".example.com", Path: "/"},
+	))
+
+	var got *http.Request
+	var report CookieReport
+	hc := NewClient(chrome.debugURL(),
+		WithBaseTransport(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			got = req
+			return &http.Response{StatusCode: http.StatusNoContent, Body: http.NoBody, Request: req}, nil
+		})),
+		WithCookieDebug(func(r CookieReport) { report = r }),
+		WithDebugCookieHeader(true),
+		WithCookieFilter(func(c *http.Cookie) bool { return c.Name != "tracker" }),
+		WithIncludePartitioned(false),
+	)
+	c := hc.Transport.(*roundTripper).client
+	defer c.Close()
+
+	// http.Client reads the jar before the transport refreshes it
+	if err := c.RefreshCookies(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := hc.Get("https://www.example.com/"); err != nil {
+		t.Fatal(err)
+	}
+	if cookie := got.Header.Get("Cookie"); cookie != "sid=abc" {
+		t.Fatalf("Cookie = %q, want sid=abc", cookie)
+	}
+	if !slices.Equal(report.Matched, []string{"sid"}) {
+		t.Errorf("report matched %v, want the cookies sent: [sid]", report.Matched)
+	}
+	want := map[string]string{
+		"host@example.com/":     "host mismatch",
+		"chips@.example.com/":   "partitioned cookie excluded",
+		"tracker@.example.com/": "excluded by cookie filter",
+	}
+	if !reflect.DeepEqual(report.Rejected, want) {
+		t.Errorf("report rejected %v, want %v", report.Rejected, want)
+	}
+	if headers := got.Header.Values("X-Debug-Cookies"); len(headers) != 1 || !strings.HasPrefix(headers[0], "sid;") {
+		t.Errorf("X-Debug-Cookies = %q, want only sid", headers)
+	}
+}
+
+func TestDebugCookieHeaderReusedRequest(t *testing.T) {
+	chrome := newFakeChrome(t, cookieHandlers(
+		&Cookie{Name: "sid", Value: "abc", Domain: ".example.com", Path: "/"},
+	))
+
+	var sent [][]string
+	hc := NewClient(chrome.debugURL(),
+		WithBaseTransport(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			sent = append(sent, req.Header.Values("X-Debug-Cookies"))
+			return &http.Response{StatusCode: http.StatusNoContent, Body: http.NoBody, Request: req}, nil
+		})),
+		WithDebugCookieHeader(true),
+	)
+	c := hc.Transport.(*roundTripper).client
+	defer c.Close()
+	if err := c.RefreshCookies(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("GET", "https://www.example.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Debug-Cookies", "stale")
+	for range 2 {
+		if _, err := hc.Do(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, headers := range sent {
+		if len(headers) != 1 || !strings.HasPrefix(headers[0], "sid;") {
+			t.Errorf("send %d: X-Debug-Cookies = %q, want only sid", i+1, headers)
+		}
+	}
+	if got := req.Header.Values("X-Debug-Cookies"); !slices.Equal(got, []string{"stale"}) {
+		t.Errorf("caller's request modified: X-Debug-Cookies = %q", got)
+	}
+}
+
+func TestUserAgentBuilder(t *testing.T) {
+	handlers := cookieHandlers()
+	handlers["Browser.getVersion"] = func(json.RawMessage) (any, error) {
+		return BrowserVersion{Product: "Chrome/126.0.1", Revision: "@abc", UserAgent: "Custom build"}, nil
+	}
+	chrome := newFakeChrome(t, handlers)
+
+	c := newClient(chrome.debugURL(), 0, WithUserAgentBuilder(func(v BrowserVersion) string {
+		return "Mozilla/5.0 " + v.Product
+	}))
+	defer c.Close()
+
+	if err := c.RefreshCookies(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if ua := c.UserAgent(); ua != "Mozilla/5.0 Chrome/126.0.1" {
+		t.Fatalf("UserAgent = %q", ua)
+	}
+}
+
+func TestConcurrentCommands(t *testing.T) {
+	handlers := cookieHandlers()
+	handlers["Echo"] = func(params json.RawMessage) (any, error) {
+		return params, nil
+	}
+	chrome := newFakeChrome(t, handlers)
+
+	cdp, err := createCDPClient(context.Background(), chrome.debugURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cdp.Close()
+
+	errc := make(chan error, 50)
+	for i := range cap(errc) {
+		go func() {
+			result, err := cdp.execute(context.Background(), "Echo", map[string]int{"n": i})
+			if err == nil && string(result) != fmt.Sprintf(`{"n":%d}`, i) {
+				err = fmt.Errorf("command %d got %s", i, result)
+			}
+			errc <- err
+		}()
+	}
+	for range cap(errc) {
+		if err := <-errc; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestCookiesForURL(t *testing.T) {
+	cookies := []*Cookie{
+		{Name: "api", Value: "1", Domain: "api.example.com", Path: "/"},
+		{Name: "shared", Value: "2", Domain: ".example.com", Path: "/"},
+		{Name: "other", Value: "3", Domain: "other.com", Path: "/"},
+	}
+
+	// The browser endpoint lacks Network.getCookies, so cookies are matched
+	// locally
+	chrome := newFakeChrome(t, cookieHandlers(cookies...))
+	c := newClient(chrome.debugURL(), 0)
+	defer c.Close()
+
+	got, err := c.CookiesForURL(context.Background(), "https://api.example.com/v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, cookie := range got {
+		names = append(names, cookie.Name)
+	}
+	if strings.Join(names, ",") != "api,shared" {
+		t.Fatalf("CookiesForURL = %v, want api and shared", names)
+	}
+}
+
+func TestToHTTPCookieExpiry(t *testing.T) {
+	c := newClient("ws://127.0.0.1:1", 0)
+	defer c.Close()
+
+	future := float64(time.Now().Add(time.Hour).Unix()) + 0.5
+	tests := []struct {
+		name    string
+		cookie  Cookie
+		expires time.Time
+		persist bool
+	}{
+		{"session", Cookie{Session: true, Expires: -1}, time.Time{}, false},
+		{"fractional", Cookie{Expires: future}, time.Unix(int64(future), 5e8), true},
+		{"far future", Cookie{Expires: 1e300}, maxCookieExpiry, true},
+	}
+	for _, tt := range tests {
+		got := c.toHTTPCookie(&tt.cookie)
+		if !got.Expires.Equal(tt.expires) {
+			t.Errorf("%s: Expires = %v, want %v", tt.name, got.Expires, tt.expires)
+		}
+		if tt.persist != (got.MaxAge > 0) {
+			t.Errorf("%s: MaxAge = %d", tt.name, got.MaxAge)
+		}
+	}
+}
+
+func TestToHTTPCookieSameSite(t *testing.T) {
+	c := newClient("ws://127.0.0.1:1", 0)
+	defer c.Close()
+
+	for sameSite, want := range map[string]http.SameSite{
+		"Strict": http.SameSiteStrictMode,
+		"Lax":    http.SameSiteLaxMode,
+		"None":   http.SameSiteNoneMode,
+		"":       http.SameSiteDefaultMode,
+		"Bogus":  http.SameSiteDefaultMode,
+	} {
+		if got := c.toHTTPCookie(&Cookie{SameSite: sameSite}).SameSite; got != want {
+			t.Errorf("SameSite %q = %v, want %v", sameSite, got, want)
+		}
+	}
+}
+
+func TestCookieScheme(t *testing.T) {
+	c := newClient("ws://127.0.0.1:1", 0)
+	defer c.Close()
+
+	tests := []struct {
+		cookie Cookie
+		want   string
+	}{
+		{Cookie{SourceScheme: "Unset"}, "http"},
+		{Cookie{SourceScheme: "Unset", Secure: true}, "https"},
+		{Cookie{SourceScheme: "Secure"}, "https"},
+		{Cookie{SourceScheme: "NonSecure"}, "http"},
+	}
+	for _, tt := range tests {
+		if got := c.cookieScheme(&tt.cookie); got != tt.want {
+			t.Errorf("cookieScheme(%+v) = %q, want %q", tt.cookie, got, tt.want)
+		}
+	}
+}
+
+func TestExtractor(t *testing.T) {
+	chrome := newFakeChrome(t, cookieHandlers(&Cookie{Name: "sid", Value: "abc", Domain: "example.com", Path: "/"}))
+
+	e := NewExtractor(chrome.debugURL())
+	defer e.Close()
+
+	if e.CacheValid() {
+		t.Fatal("cache valid before the first refresh")
+	}
+	if err := e.RefreshCookies(context.Background()); err != nil {
+		t.Fatalf("RefreshCookies: %v", err)
+	}
+	if !e.CacheValid() {
+		t.Fatal("cache invalid after refresh")
+	}
+	if e.UserAgent() == "" {
+		t.Fatal("empty user agent")
+	}
+	got := e.Jar.Cookies(&url.URL{Scheme: "https", Host: "example.com", Path: "/"})
+	if len(got) != 1 || got[0].Value != "abc" {
+		t.Fatalf("Jar.Cookies = %v", got)
+	}
+}
+
+func TestExtractorClient(t *testing.T) {
+	chrome := newFakeChrome(t, cookieHandlers(&Cookie{Name: "sid", Value: "abc", Domain: "example.com", Path: "/"}))
+
+	e := NewExtractor(chrome.debugURL())
+	defer e.Close()
+	var got *http.Request
+	hc := e.Client(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		got = req
+		return &http.Response{StatusCode: http.StatusNoContent, Body: http.NoBody, Request: req}, nil
+	}))
+
+	// The first request refreshes the cookies, the second one carries them
+	for range 2 {
+		if _, err := hc.Get("https://example.com/"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if cookie := got.Header.Get("Cookie"); cookie != "sid=abc" {
+		t.Errorf("Cookie = %q, want sid=abc", cookie)
+	}
+	if ua := got.Header.Get("User-Agent"); ua != "FakeChrome/1.0" {
+		t.Errorf("User-Agent = %q, want FakeChrome/1.0", ua)
+	}
+	if !e.CacheValid() {
+		t.Error("request did not refresh the Extractor's cache")
+	}
+}
+
+func TestAutoRefresh(t *testing.T) {
+	var calls atomic.Int64
+	handlers := cookieHandlers(&Cookie{Name: "sid", Value: "abc", Domain: "example.com", Path: "/"})
+	getCookies := handlers["Storage.getCookies"]
+	handlers["Storage.getCookies"] = func(params json.RawMessage) (any, error) {
+		calls.Add(1)
+		return getCookies(params)
+	}
+	chrome := newFakeChrome(t, handlers)
+
+	e := NewExtractor(chrome.debugURL())
+	defer e.Close()
+
+	e.StartAutoRefresh(context.Background(), 10*time.Millisecond)
+	deadline := time.Now().Add(2 * time.Second)
+	for calls.Load() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("refreshed %d times, want at least 2", calls.Load())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if !e.CacheValid() {
+		t.Fatal("cache invalid after background refresh")
+	}
+
+	e.StopAutoRefresh()
+	e.StopAutoRefresh()
+	n := calls.Load()
+	time.Sleep(50 * time.Millisecond)
+	if got := calls.Load(); got != n {
+		t.Fatalf("refreshed %d times after StopAutoRefresh", got-n)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	e.StartAutoRefresh(ctx, time.Hour)
+	cancel()
+	e.StopAutoRefresh()
+
+	// Concurrent starts leave a single refresh that one stop ends
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			e.StartAutoRefresh(context.Background(), 10*time.Millisecond)
+		}()
+	}
+	wg.Wait()
+	e.StopAutoRefresh()
+	n = calls.Load()
+	time.Sleep(50 * time.Millisecond)
+	if got := calls.Load(); got != n {
+		t.Fatalf("refreshed %d times after concurrent starts and StopAutoRefresh", got-n)
+	}
+
+	// A non-positive interval stops instead of panicking
+	e.StartAutoRefresh(context.Background(), 10*time.Millisecond)
+	e.StartAutoRefresh(context.Background(), 0)
+	n = calls.Load()
+	time.Sleep(50 * time.Millisecond)
+	if got := calls.Load(); got != n {
+		t.Fatalf("refreshed %d times after StartAutoRefresh(0)", got-n)
+	}
+}
+
+func TestConcurrentRequestsShareRefresh(t *testing.T) {
+	var calls atomic.Int64
+	handlers := cookieHandlers(&Cookie{Name: "sid", Value: "abc", Domain: "example.com", Path: "/"})
+	getCookies := handlers["Storage.getCookies"]
+	handlers["Storage.getCookies"] = func(params json.RawMessage) (any, error) {
+		calls.Add(1)
+		time.Sleep(50 * time.Millisecond)
+		return getCookies(params)
+	}
+	chrome := newFakeChrome(t, handlers)
+
+	c := newClient(chrome.debugURL(), 0)
+	defer c.Close()
+	rt := &roundTripper{
+		base: roundTripFunc(func(*http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+		}),
+		client: c,
+	}
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Go(func() {
+			req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+			if _, err := rt.RoundTrip(req); err != nil {
+				t.Errorf("RoundTrip: %v", err)
+			}
+		})
+	}
+	wg.Wait()
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("refreshed %d times, want 1", n)
+	}
+}
+
+func TestRoundTripKeepsUserAgent(t *testing.T) {
+	c := newClient("ws://127.0.0.1:1", 0, WithUserAgentOverride("Chrome/1.0"), WithInitialCookies([]*http.Cookie{{Name: "a", Value: "b", Domain: "example.com"}}))
+	defer c.Close()
+	var got []string
+	rt := &roundTripper{
+		base: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			got = append(got, req.Header.Get("User-Agent"))
+			return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+		}),
+		client: c,
+	}
+
+	for _, ua := range []string{"", "Custom/2.0"} {
+		req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+		if ua != "" {
+			req.Header.Set("User-Agent", ua)
+		}
+		if _, err := rt.RoundTrip(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := []string{"Chrome/1.0", "Custom/2.0"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("User-Agent = %q, want %q", got, want)
+	}
+}
+
+func TestCloseContextWaitsForReader(t *testing.T) {
+	chrome := newFakeChrome(t, cookieHandlers(&Cookie{Name: "sid", Value: "abc", Domain: "example.com", Path: "/"}))
+
+	c := newClient(chrome.debugURL(), 0)
+	if err := c.RefreshCookies(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	cdpClient := c.cdpClient
+
+	if err := c.CloseContext(context.Background()); err != nil {
+		t.Fatalf("CloseContext: %v", err)
+	}
+	select {
+	case <-cdpClient.readDone:
+	default:
+		t.Fatal("reader still running after CloseContext")
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("second Close: %v", err)
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	f := &fakeChrome{handlers: cookieHandlers(&Cookie{Name: "sid", Value: "abc", Domain: "example.com", Path: "/"})}
+	f.Server = httptest.NewTLSServer(http.HandlerFunc(f.serveHTTP))
+	defer f.Close()
+	if !strings.HasPrefix(f.debugURL(), "wss://") {
+		t.Fatalf("debug URL %q", f.debugURL())
+	}
+
+	c := newClient(f.debugURL(), 0)
+	if err := c.RefreshCookies(context.Background()); err == nil {
+		t.Fatal("RefreshCookies trusted an unknown CA")
+	}
+	c.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(f.Certificate())
+	c = newClient(f.debugURL(), 0, WithTLSConfig(&tls.Config{RootCAs: roots}))
+	defer c.Close()
+	if err := c.RefreshCookies(context.Background()); err != nil {
+		t.Fatalf("RefreshCookies: %v", err)
+	}
+	if got := c.SnapshotCookies(); len(got) != 1 {
+		t.Fatalf("got %d cookies, want 1", len(got))
+	}
+}
+
+func TestAuthHeader(t *testing.T) {
+	f := &fakeChrome{handlers: cookieHandlers(&Cookie{Name: "sid", Value: "abc", Domain: "example.com", Path: "/"})}
+	var unauthorized atomic.Int64
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer s3cret" {
+			unauthorized.Add(1)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		f.serveHTTP(w, r)
+	}))
+	defer f.Close()
+
+	c := newClient(f.debugURL(), 0, WithAuthHeader("Authorization", "Bearer s3cret"))
+	defer c.Close()
+	if err := c.RefreshCookies(context.Background()); err != nil {
+		t.Fatalf("RefreshCookies: %v", err)
+	}
+	if n := unauthorized.Load(); n != 0 {
+		t.Fatalf("%d unauthorized requests", n)
+	}
+
+	err := c.dialOpts.redact(errors.New(`GET failed: header "Bearer s3cret"`))
+	if strings.Contains(err.Error(), "s3cret") {
+		t.Fatalf("error not redacted: %v", err)
+	}
+}
+
+func TestStats(t *testing.T) {
+	chrome := newFakeChrome(t, cookieHandlers(&Cookie{Name: "sid", Value: "abc", Domain: "example.com", Path: "/"}))
+
+	c := newClient(chrome.debugURL(), 0, WithConnectRetries(0))
+	defer c.Close()
+	if s := c.Stats(); s.Connected || s.CacheValid || s.RefreshCount != 0 || s.LastError != nil {
+		t.Fatalf("Stats before refreshing = %+v", s)
+	}
+
+	for range 2 {
+		if err := c.RefreshCookies(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := c.Stats()
+	if !s.Connected || !s.CacheValid || s.RefreshCount != 2 || s.LastRefresh.IsZero() {
+		t.Fatalf("Stats after refreshing = %+v", s)
+	}
+
+	c.disconnect()
+	c.dialFunc = func(ctx context.Context, debugURL string) (*cdpClient, error) {
+		return nil, errors.New("dial refused")
+	}
+	if _, err := c.ensureConnection(context.Background()); err == nil {
+		t.Fatal("ensureConnection succeeded")
+	}
+	if s := c.Stats(); s.Connected || s.LastError == nil || !strings.Contains(s.LastError.Error(), "dial refused") {
+		t.Fatalf("Stats after failing to connect = %+v", s)
+	}
+}
+
+func TestLogger(t *testing.T) {
+	chrome := newFakeChrome(t, cookieHandlers(&Cookie{Name: "sid", Value: "abc", Domain: "example.com", Path: "/"}))
+
+	var buf strings.Builder
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	c := newClient(chrome.debugURL(), 0, WithLogger(logger), WithName("test"))
+	if err := c.RefreshCookies(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	c.disconnect()
+	c.Close()
+
+	for _, want := range []string{"refreshing cookies", "connected to Chrome", "refreshed cookies", "count=1", "disconnected from Chrome", "client=test"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("log lacks %q:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestCookieFilter(t *testing.T) {
+	chrome := newFakeChrome(t, cookieHandlers(
+		&Cookie{Name: "sid", Value: "abc", Domain: "example.com", Path: "/"},
+		&Cookie{Name: "_ga", Value: "track", Domain: "example.com", Path: "/"},
+		&Cookie{Name: "other", Value: "x", Domain: "other.com", Path: "/"},
+	))
+
+	c := newClient(chrome.debugURL(), 0, WithCookieFilter(func(cookie *http.Cookie) bool {
+		return cookie.Domain == "example.com" && !strings.HasPrefix(cookie.Name, "_ga")
+	}))
+	defer c.Close()
+	if err := c.RefreshCookies(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := c.CookieHeader(&url.URL{Scheme: "https", Host: "example.com", Path: "/"}); got != "sid=abc" {
+		t.Fatalf("example.com cookies = %q, want sid=abc", got)
+	}
+	if got := c.CookieHeader(&url.URL{Scheme: "https", Host: "other.com", Path: "/"}); got != "" {
+		t.Fatalf("other.com cookies = %q, want none", got)
+	}
+}
+
+func TestWriteNetscapeCookies(t *testing.T) {
+	chrome := newFakeChrome(t, cookieHandlers(
+		&Cookie{Name: "sid", Value: "abc", Domain: ".example.com", Path: "/", Expires: 2000000000.5, Secure: true, HTTPOnly: true},
+		&Cookie{Name: "pref", Value: "dark", Domain: "www.example.com", Path: "/app", Session: true, Expires: -1},
+	))
+
+	c := newClient(chrome.debugURL(), 0)
+	defer c.Close()
+	if err := c.RefreshCookies(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf strings.Builder
+	if err := c.WriteNetscapeCookies(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := "# Netscape HTTP Cookie File\n\n" +
+		"#HttpOnly_.example.com\tTRUE\t/\tTRUE\t2000000000\tsid\tabc\n" +
+		"www.example.com\tFALSE\t/app\tFALSE\t0\tpref\tdark\n"
+	if buf.String() != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+func TestWriteNetscapeCookiesImportedAndDomainless(t *testing.T) {
+	chrome := newFakeChrome(t, cookieHandlers(
+		&Cookie{Name: "sid", Value: "abc", Domain: "example.com", Path: "/", Session: true, Expires: -1},
+		&Cookie{Name: "orphan", Value: "1", Path: "/", Session: true, Expires: -1},
+	))
+
+	for _, tt := range []struct {
+		defaultDomain string
+		want          string
+	}{
+		{"", "example.com\tFALSE\t/\tFALSE\t0\tsid\tabc\n" +
+			".seeded.example\tTRUE\t/\tFALSE\t0\tsaved\t1\n"},
+		{"app.example", "app.example\tFALSE\t/\tFALSE\t0\torphan\t1\n" +
+			"example.com\tFALSE\t/\tFALSE\t0\tsid\tabc\n" +
+			".seeded.example\tTRUE\t/\tFALSE\t0\tsaved\t1\n"},
+	} {
+		opts := []Option{WithInitialCookies([]*http.Cookie{{Name: "saved", Value: "1", Domain: "seeded.example"}})}
+		if tt.defaultDomain != "" {
+			opts = append(opts, WithDefaultCookieDomain(func() string { return tt.defaultDomain }))
+		}
+		c := newClient(chrome.debugURL(), 0, opts...)
+		err := c.RefreshCookies(context.Background())
+		var buf strings.Builder
+		if err == nil {
+			err = c.WriteNetscapeCookies(&buf)
+		}
+		c.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := "# Netscape HTTP Cookie File\n\n" + tt.want
+		if buf.String() != want {
+			t.Errorf("default domain %q: got:\n%s\nwant:\n%s", tt.defaultDomain, buf.String(), want)
+		}
+	}
+}
+
+func TestWriteNetscapeCookiesMaxExpiry(t *testing.T) {
+	chrome := newFakeChrome(t, cookieHandlers(
+		&Cookie{Name: "far", Value: "1", Domain: ".example.com", Path: "/", Expires: 1e12},
+	))
+
+	for _, tt := range []struct {
+		opts []Option
+		want time.Time
+	}{
+		{nil, maxCookieExpiry},
+		{[]Option{WithMaxExpiry(time.Hour)}, time.Now().Add(time.Hour)},
+	} {
+		c := newClient(chrome.debugURL(), 0, tt.opts...)
+		if err := c.RefreshCookies(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		var buf strings.Builder
+		err := c.WriteNetscapeCookies(&buf)
+		c.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fields := strings.Split(strings.TrimSpace(buf.String()), "\t")
+		expires, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d := time.Unix(expires, 0).Sub(tt.want); d < -time.Minute || d > time.Minute {
+			t.Errorf("expiry = %v, want about %v", time.Unix(expires, 0), tt.want)
+		}
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	var chrome *fakeChrome
+	handlers := cookieHandlers()
+	handlers["Target.getTargetInfo"] = func(json.RawMessage) (any, error) {
+		return getTargetInfoResponse{TargetInfo: targetInfo{TargetID: "browser", Type: "browser"}}, nil
+	}
+	handlers["Runtime.evaluate"] = func(params json.RawMessage) (any, error) {
+		if path := chrome.lastPath.Load(); path != "/devtools/page/1" {
+			return nil, fmt.Errorf("evaluated on %v", path)
+		}
+		var p struct {
+			Expression    string `json:"expression"`
+			ReturnByValue bool   `json:"returnByValue"`
+		}
+		json.Unmarshal(params, &p)
+		if p.Expression == "throw" {
+			return map[string]any{
+				"result":           map[string]any{"type": "object"},
+				"exceptionDetails": map[string]any{"text": "Uncaught", "exception": map[string]any{"type": "object", "description": "Error: boom"}},
+			}, nil
+		}
+		if !p.ReturnByValue {
+			return nil, errors.New("returnByValue not set")
+		}
+		return map[string]any{"result": map[string]any{"type": "string", "value": "token"}}, nil
+	}
+	chrome = newFakeChrome(t, handlers)
+	chrome.targets = []Target{{ID: "1", Type: "page", WebSocketDebuggerURL: chrome.debugURL() + "/devtools/page/1"}}
+
+	c := newClient(chrome.debugURL(), 0)
+	defer c.Close()
+
+	value, err := c.Evaluate(context.Background(), "window.csrf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != `"token"` {
+		t.Fatalf("value = %s", value)
+	}
+	if _, err := c.Evaluate(context.Background(), "throw"); err == nil || !strings.Contains(err.Error(), "Error: boom") {
+		t.Fatalf("error = %v, want the exception", err)
+	}
+}
+
+func TestIncludePartitioned(t *testing.T) {
+	chrome := newFakeChrome(t, cookieHandlers(
+		&Cookie{Name: "sid", Value: "first-party", Domain: "example.com", Path: "/"},
+		&Cookie{Name: "sid", Value: "embedded", Domain: "example.com", Path: "/", PartitionKey: &CookiePartitionKey{TopLevelSite: "https://other.com"}},
+	))
+
+	c := newClient(chrome.debugURL(), 0, WithIncludePartitioned(false))
+	defer c.Close()
+	if err := c.RefreshCookies(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.CookieHeader(&url.URL{Scheme: "https", Host: "example.com", Path: "/"}); got != "sid=first-party" {
+		t.Fatalf("cookies = %q, want sid=first-party", got)
+	}
+	if got := c.SnapshotCookies(); len(got) != 2 {
+		t.Fatalf("snapshot has %d cookies, want both", len(got))
+	}
+
+	raw, err := c.RawCDPCookies(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, cookie := range raw {
+		if cookie.PartitionKey != nil {
+			keys = append(keys, cookie.PartitionKey.TopLevelSite)
+		}
+	}
+	if len(keys) != 1 || keys[0] != "https://other.com" {
+		t.Fatalf("partition keys = %q", keys)
+	}
+}
+
+func TestVersionHTMLResponse(t *testing.T) {
+	for _, tt := range []struct {
+		status int
+		want   []string
+	}{
+		{http.StatusOK, []string{"did not return JSON", "text/html", "<html><body>Grafana"}},
+		{http.StatusBadGateway, []string{"502 Bad Gateway", "<html><body>Grafana"}},
+		{http.StatusNotFound, []string{"404 Not Found", "<html><body>Grafana"}},
+	} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			w.WriteHeader(tt.status)
+			w.Write([]byte("<html><body>Grafana" + strings.Repeat(" ", 1000) + "</body></html>"))
+		}))
+		_, err := getWebSocketURL(context.Background(), &dialOptions{}, "ws"+strings.TrimPrefix(srv.URL, "http"))
+		srv.Close()
+		if err == nil {
+			t.Fatalf("status %d: no error", tt.status)
+		}
+		for _, want := range tt.want {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("status %d: error %q lacks %q", tt.status, err, want)
+			}
+		}
+		if len(err.Error()) > 500 {
+			t.Errorf("status %d: error not truncated: %d bytes", tt.status, len(err.Error()))
+		}
+	}
+}
+
+func TestBlockedVersionFallback(t *testing.T) {
+	f := &fakeChrome{handlers: cookieHandlers(&Cookie{Name: "sid", Value: "abc", Domain: "example.com", Path: "/"})}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/json/version" {
+			http.Error(w, "blocked by proxy", http.StatusForbidden)
+			return
+		}
+		f.serveHTTP(w, r)
+	}))
+	defer f.Close()
+
+	c := newClient(f.debugURL(), 0)
+	defer c.Close()
+	if err := c.RefreshCookies(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if path := f.lastPath.Load(); path != "/devtools/browser" {
+		t.Errorf("websocket path = %v, want the guessed /devtools/browser", path)
+	}
+}
+
+func TestVersionRetry(t *testing.T) {
+	f := &fakeChrome{handlers: cookieHandlers(&Cookie{Name: "sid", Value: "abc", Domain: "example.com", Path: "/"})}
+	var versionRequests atomic.Int64
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/json/version" && versionRequests.Add(1) <= 2 {
+			http.Error(w, "starting", http.StatusServiceUnavailable)
+			return
+		}
+		f.serveHTTP(w, r)
+	}))
+	defer f.Close()
+
+	opts := &dialOptions{versionRetries: 1, versionRetryDelay: time.Millisecond}
+	if _, err := getWebSocketURL(context.Background(), opts, f.debugURL()); err == nil {
+		t.Fatal("succeeded with too few retries")
+	}
+
+	versionRequests.Store(0)
+	c := newClient(f.debugURL(), 0, WithConnectRetries(0), WithVersionRetry(3, time.Millisecond))
+	defer c.Close()
+	if err := c.RefreshCookies(context.Background()); err != nil {
+		t.Fatalf("RefreshCookies: %v", err)
+	}
+	if n := versionRequests.Load(); n != 3 {
+		t.Fatalf("fetched /json/version %d times, want 3", n)
+	}
+}
+
+func TestDirectWebSocketURL(t *testing.T) {
+	f := &fakeChrome{handlers: cookieHandlers(&Cookie{Name: "sid", Value: "abc", Domain: "example.com", Path: "/"})}
+	var hosts []string
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hosts = append(hosts, r.Host)
+		f.serveHTTP(w, r)
+	}))
+	defer f.Close()
+
+	hc := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, f.Listener.Addr().String())
+		},
+	}}
+	c := newClient("ws://unused:1", 0, WithHTTPClient(hc), WithDirectWebSocketURL("ws://chrome:9222/devtools/browser/fake"))
+	defer c.Close()
+	if err := c.RefreshCookies(context.Background()); err != nil {
+		t.Fatalf("RefreshCookies: %v", err)
+	}
+	if want := []string{"chrome:9222"}; !reflect.DeepEqual(hosts, want) {
+		t.Fatalf("requested hosts %q, want %q", hosts, want)
+	}
+
+	c = newClient("ws://unused:1", 0, WithConnectRetries(0), WithDirectWebSocketURL("http://chrome:9222/devtools/browser/fake"))
+	defer c.Close()
+	if err := c.RefreshCookies(context.Background()); err == nil || !strings.Contains(err.Error(), "must use ws or wss") {
+		t.Fatalf("error = %v, want a scheme error", err)
+	}
+}
+
+func TestForceIPDisabled(t *testing.T) {
+	f := &fakeChrome{handlers: cookieHandlers(&Cookie{Name: "sid", Value: "abc", Domain: "example.com", Path: "/"})}
+	var hosts []string
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hosts = append(hosts, r.Host)
+		f.serveHTTP(w, r)
+	}))
+	defer f.Close()
+
+	hc := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, f.Listener.Addr().String())
+		},
+	}}
+	c := newClient("ws://chrome:9222", 0, WithHTTPClient(hc), WithForceIP(false))
+	defer c.Close()
+	if err := c.RefreshCookies(context.Background()); err != nil {
+		t.Fatalf("RefreshCookies: %v", err)
+	}
+	if len(hosts) == 0 || hosts[0] != "chrome:9222" {
+		t.Fatalf("requested hosts %q, want chrome:9222 first", hosts)
+	}
+}
+
+func TestSkipRefresh(t *testing.T) {
+	var dials atomic.Int64
+	c := newClient("ws://127.0.0.1:1", 0, WithConnectRetries(0))
+	c.dialFunc = func(ctx context.Context, debugURL string) (*cdpClient, error) {
+		dials.Add(1)
+		return nil, errors.New("dial refused")
+	}
+	defer c.Close()
+	var headers []string
+	rt := &roundTripper{
+		base: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			headers = append(headers, req.Header.Get(SkipRefreshHeader))
+			return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+		}),
+		client: c,
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/healthz", nil)
+	req.Header.Set(SkipRefreshHeader, "1")
+	for range 2 {
+		if _, err := rt.RoundTrip(req); err != nil {
+			t.Fatalf("RoundTrip with header: %v", err)
+		}
+	}
+	if req.Header.Get(SkipRefreshHeader) == "" {
+		t.Fatalf("%s removed from the caller's request", SkipRefreshHeader)
+	}
+	req = httptest.NewRequest(http.MethodGet, "https://example.com/healthz", nil).WithContext(SkipRefresh(context.Background()))
+	if _, err := rt.RoundTrip(req); err != nil {
+		t.Fatalf("RoundTrip with context: %v", err)
+	}
+	if n := dials.Load(); n != 0 {
+		t.Fatalf("dialed %d times", n)
+	}
+	if want := []string{"", "", ""}; !reflect.DeepEqual(headers, want) {
+		t.Fatalf("sent %s headers %q", SkipRefreshHeader, headers)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+	if _, err := rt.RoundTrip(req); err == nil {
+		t.Fatal("RoundTrip without bypass succeeded without Chrome")
+	}
+}
+
+func TestEndpointsFailover(t *testing.T) {
+	primary := newFakeChrome(t, cookieHandlers(&Cookie{Name: "sid", Value: "primary", Domain: "example.com", Path: "/"}))
+	backup := newFakeChrome(t, cookieHandlers(&Cookie{Name: "sid", Value: "backup", Domain: "example.com", Path: "/"}))
+
+	c := newClient("", 0, WithConnectRetries(0), WithEndpoints([]string{primary.debugURL(), backup.debugURL()}))
+	defer c.Close()
+	refresh := func() string {
+		t.Helper()
+		if err := c.RefreshCookies(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		return c.CookieHeader(&url.URL{Scheme: "https", Host: "example.com", Path: "/"})
+	}
+
+	if got := refresh(); got != "sid=primary" {
+		t.Fatalf("cookies = %q, want the primary's", got)
+	}
+	if got := c.Stats().Endpoint; got != primary.debugURL() {
+		t.Fatalf("endpoint = %q, want %q", got, primary.debugURL())
+	}
+
+	primary.CloseClientConnections()
+	primary.Close()
+	c.disconnect()
+	if got := refresh(); got != "sid=backup" {
+		t.Fatalf("cookies = %q, want the backup's", got)
+	}
+	if got := c.Stats().Endpoint; got != backup.debugURL() {
+		t.Fatalf("endpoint = %q, want %q", got, backup.debugURL())
+	}
+
+	// Stays on the backup
+	c.disconnect()
+	refresh()
+	if got := c.Stats().Endpoint; got != backup.debugURL() {
+		t.Fatalf("endpoint = %q after reconnecting, want %q", got, backup.debugURL())
+	}
+}
+
+func TestLeadingDotDomain(t *testing.T) {
+	chrome := newFakeChrome(t, cookieHandlers(
+		&Cookie{Name: "sid", Value: "abc", Domain: ".example.com", Path: "/"},
+		&Cookie{Name: "host", Value: "only", Domain: "www.example.com", Path: "/"},
+		&Cookie{Name: "intra", Value: "x", Domain: ".intranet", Path: "/"},
+	))
+
+	for _, sharded := range []bool{false, true} {
+		opts := []Option{WithAllowSingleLabelDomains(true)}
+		if sharded {
+			opts = append(opts, WithShardedJar())
+		}
+		c := newClient(chrome.debugURL(), 0, opts...)
+		if err := c.RefreshCookies(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		for host, want := range map[string]string{
+			"sub.example.com":  "sid=abc",
+			"example.com":      "sid=abc",
+			"www.example.com":  "host=only; sid=abc",
+			"wiki.intranet":    "intra=x",
+			"example.com.evil": "",
+		} {
+			parts := strings.Split(c.CookieHeader(&url.URL{Scheme: "https", Host: host, Path: "/"}), "; ")
+			slices.Sort(parts)
+			if got := strings.Join(parts, "; "); got != want {
+				t.Errorf("sharded %v: cookies for %s = %q, want %q", sharded, host, got, want)
+			}
+		}
+		c.Close()
+	}
+}
+
+func TestDialContext(t *testing.T) {
+	chrome := newFakeChrome(t, cookieHandlers(&Cookie{Name: "sid", Value: "abc", Domain: "example.com", Path: "/"}))
+
+	var dialed []string
+	c := newClient(chrome.debugURL(), 0, WithDialContext(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}))
+	defer c.Close()
+	if err := c.RefreshCookies(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// The /json/version connection may be reused for the websocket
+	if len(dialed) == 0 || dialed[0] != chrome.Listener.Addr().String() {
+		t.Fatalf("dialed %q, want %s", dialed, chrome.Listener.Addr())
+	}
+}
+
+func TestRefreshCookiesN(t *testing.T) {
+	chrome := newFakeChrome(t, cookieHandlers(
+		&Cookie{Name: "a", Value: "1", Domain: "example.com", Path: "/"},
+		&Cookie{Name: "b", Value: "2", Domain: "example.com", Path: "/"},
+	))
+
+	c := newClient(chrome.debugURL(), 0, WithConnectRetries(0))
+	defer c.Close()
+	n, err := c.RefreshCookiesN(context.Background())
+	if err != nil || n != 2 {
+		t.Fatalf("RefreshCookiesN = %d, %v, want 2", n, err)
+	}
+
+	c.disconnect()
+	c.dialFunc = func(ctx context.Context, debugURL string) (*cdpClient, error) {
+		return nil, errors.New("dial refused")
+	}
+	n, err = c.RefreshCookiesN(context.Background())
+	if err != nil || n != -1 {
+		t.Fatalf("RefreshCookiesN with cache = %d, %v, want -1", n, err)
+	}
+	if n := c.LastCookieCount(); n != 2 {
+		t.Fatalf("LastCookieCount = %d, want 2", n)
+	}
+}
+
+func TestPing(t *testing.T) {
+	var cookieFetches atomic.Int64
+	handlers := cookieHandlers()
+	handlers["Storage.getCookies"] = func(json.RawMessage) (any, error) {
+		cookieFetches.Add(1)
+		return getCookiesResponses{}, nil
+	}
+	chrome := newFakeChrome(t, handlers)
+
+	c := newClient(chrome.debugURL(), 0)
+	defer c.Close()
+	if err := c.Ping(context.Background()); err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+	if n := cookieFetches.Load(); n != 0 {
+		t.Fatalf("Ping fetched cookies %d times", n)
+	}
+	if c.CacheValid() || c.UserAgent() != "" {
+		t.Fatal("Ping updated the cache")
+	}
+
+	down := newClient("ws://127.0.0.1:1", 0, WithConnectRetries(0))
+	defer down.Close()
+	if err := down.Ping(context.Background()); !errors.Is(err, ErrChromeUnavailable) {
+		t.Fatalf("Ping without Chrome = %v, want ErrChromeUnavailable", err)
+	}
+}
+
+func TestOnCookieChange(t *testing.T) {
+	var session atomic.Value
+	session.Store("v1")
+	handlers := cookieHandlers()
+	handlers["Storage.getCookies"] = func(json.RawMessage) (any, error) {
+		return getCookiesResponses{Cookies: []*Cookie{
+			{Name: "sid", Value: session.Load().(string), Domain: "example.com", Path: "/"},
+			{Name: "pref", Value: "dark", Domain: "example.com", Path: "/"},
+		}}, nil
+	}
+	chrome := newFakeChrome(t, handlers)
+
+	var deltas []CookieDelta
+	c := newClient(chrome.debugURL(), 0, WithOnCookieChange(func(d CookieDelta) {
+		deltas = append(deltas, d)
+	}))
+	defer c.Close()
+
+	for _, v := range []string{"v1", "v1", "v2"} {
+		session.Store(v)
+		if err := c.RefreshCookies(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(deltas) != 2 {
+		t.Fatalf("got %d deltas, want 2", len(deltas))
+	}
+	if len(deltas[0].Added) != 2 {
+		t.Fatalf("first delta = %+v, want both cookies added", deltas[0])
+	}
+	if d := deltas[1]; len(d.Added) != 0 || len(d.Removed) != 0 || len(d.Changed) != 1 || d.Changed[0].Value != "v2" {
+		t.Fatalf("second delta = %+v, want sid changed to v2", d)
+	}
+}
+
+func TestWaitForCookie(t *testing.T) {
+	var polls atomic.Int64
+	handlers := cookieHandlers()
+	handlers["Storage.getCookies"] = func(json.RawMessage) (any, error) {
+		cookies := []*Cookie{{Name: "csrftoken", Value: "x", Domain: "example.com", Path: "/"}}
+		if polls.Add(1) >= 3 {
+			cookies = append(cookies, &Cookie{Name: "sessionid", Value: "abc", Domain: ".example.com", Path: "/"})
+		}
+		return getCookiesResponses{Cookies: cookies}, nil
+	}
+	chrome := newFakeChrome(t, handlers)
+
+	c := newClient(chrome.debugURL(), 0, WithCookiePollInterval(time.Millisecond))
+	defer c.Close()
+
+	cookie, err := c.WaitForCookie(context.Background(), "sessionid", "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cookie.Value != "abc" || polls.Load() != 3 {
+		t.Fatalf("got %v after %d polls, want sessionid=abc after 3", cookie, polls.Load())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := c.WaitForCookie(ctx, "sessionid", "other.com"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("error = %v, want DeadlineExceeded", err)
+	}
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	for _, tt := range []struct {
+		backoff ExponentialBackoff
+		attempt int
+		want    time.Duration
+	}{
+		{ExponentialBackoff{Base: 100 * time.Millisecond, Max: time.Second}, 0, 100 * time.Millisecond},
+		{ExponentialBackoff{Base: 100 * time.Millisecond, Max: time.Second}, 3, 800 * time.Millisecond},
+		{ExponentialBackoff{Base: 100 * time.Millisecond, Max: time.Second}, 4, time.Second},
+		{ExponentialBackoff{Base: 100 * time.Millisecond}, 2, 400 * time.Millisecond},
+		{ExponentialBackoff{Base: 100 * time.Millisecond}, 1000, math.MaxInt64},
+		{ExponentialBackoff{Base: 2 * time.Second, Max: time.Second}, 0, time.Second},
+	} {
+		if got := tt.backoff.Next(tt.attempt); got != tt.want {
+			t.Errorf("%+v.Next(%d) = %v, want %v", tt.backoff, tt.attempt, got, tt.want)
+		}
+	}
+}
+
+// suffixList is a public suffix list of fixed suffixes
+type suffixList []string
+
+func (l suffixList) PublicSuffix(domain string) string {
+	for _, suffix := range l {
+		if domain == suffix || strings.HasSuffix(domain, "."+suffix) {
+			return suffix
+		}
+	}
+	return domain[strings.LastIndex(domain, ".")+1:]
+}
+
+func (l suffixList) String() string { return "test list" }
+
+func TestCookiesByRegistrableDomain(t *testing.T) {
+	chrome := newFakeChrome(t, cookieHandlers(
+		&Cookie{Name: "a", Value: "1", Domain: ".a.co.uk", Path: "/"},
+		&Cookie{Name: "b", Value: "2", Domain: "www.b.co.uk", Path: "/"},
+		&Cookie{Name: "c", Value: "3", Domain: "shop.b.co.uk", Path: "/"},
+	))
+
+	c := newClient(chrome.debugURL(), 0)
+	if _, err := c.CookiesByRegistrableDomain(context.Background()); !errors.Is(err, ErrNoPublicSuffixList) {
+		t.Fatalf("error without list = %v, want ErrNoPublicSuffixList", err)
+	}
+	c.Close()
+
+	c = newClient(chrome.debugURL(), 0, WithPublicSuffixList(suffixList{"co.uk"}))
+	defer c.Close()
+	groups, err := c.CookiesByRegistrableDomain(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string][]string)
+	for domain, cookies := range groups {
+		for _, cookie := range cookies {
+			got[domain] = append(got[domain], cookie.Name)
+		}
+		slices.Sort(got[domain])
+	}
+	want := map[string][]string{"a.co.uk": {"a"}, "b.co.uk": {"b", "c"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("groups = %v, want %v", got, want)
+	}
+}
+
+func TestCacheValidatorFallback(t *testing.T) {
+	for _, tt := range []struct {
+		ttl   time.Duration
+		valid bool
+	}{
+		{time.Nanosecond, true}, // validator keeps expired cache
+		{time.Hour, false},      // validator rejects fresh cache
+	} {
+		c := newClient("ws://127.0.0.1:1", tt.ttl,
+			WithInitialCookies([]*http.Cookie{{Name: "sid", Value: "abc", Domain: "example.com", Path: "/"}}),
+			WithCacheValidator(func(time.Time, []*http.Cookie) bool { return tt.valid }),
+			WithConnectRetries(0),
+		)
+		time.Sleep(time.Millisecond)
+		err := c.RefreshCookies(context.Background())
+		c.Close()
+		if (err == nil) != tt.valid {
+			t.Errorf("validator %v: refresh error = %v", tt.valid, err)
+		}
+	}
+}
+
+func TestCacheValidatorUsesClient(t *testing.T) {
+	var generation atomic.Int64
+	handlers := cookieHandlers()
+	handlers["Storage.getCookies"] = func(json.RawMessage) (any, error) {
+		value := strconv.FormatInt(generation.Add(1), 10)
+		return getCookiesResponses{Cookies: []*Cookie{
+			{Name: "a", Value: value, Domain: "example.com", Path: "/"},
+			{Name: "b", Value: value, Domain: "example.com", Path: "/"},
+		}}, nil
+	}
+	chrome := newFakeChrome(t, handlers)
+
+	var c *client
+	c = newClient(chrome.debugURL(), 0, WithCacheValidator(func(last time.Time, cookies []*http.Cookie) bool {
+		// The validator may use the client while a refresh is applied
+		c.SnapshotCookies()
+		c.LastCookieCount()
+		if len(cookies) == 2 && cookies[0].Value != cookies[1].Value {
+			t.Errorf("validator got a torn snapshot: %v", cookies)
+		}
+		return !last.IsZero()
+	}))
+	defer c.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range 10 {
+			c.RefreshCookies(context.Background())
+		}
+	}()
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case <-done:
+			if !c.CacheValid() {
+				t.Fatal("cache invalid after refreshes")
+			}
+			return
+		case <-deadline:
+			t.Fatal("deadlocked")
+		default:
+			c.CacheValid()
+		}
+	}
+}
+
+func TestEnsureConnectionRetries(t *testing.T) {
+	chrome := newFakeChrome(t, cookieHandlers(&Cookie{Name: "sid", Value: "abc", Domain: "example.com", Path: "/"}))
+
+	var dials atomic.Int64
+	c := newClient(chrome.debugURL(), 0, WithBackoff(ConstantBackoff(time.Millisecond)))
+	c.dialFunc = func(ctx context.Context, debugURL string) (*cdpClient, error) {
+		if dials.Add(1) <= 2 {
+			return nil, errors.New("dial refused")
+		}
+		return createCDPClient(ctx, debugURL)
+	}
+	defer c.Close()
+
+	if err := c.RefreshCookies(context.Background()); err != nil {
+		t.Fatalf("RefreshCookies: %v", err)
+	}
+	if n := dials.Load(); n != 3 {
+		t.Fatalf("dialed %d times, want 3", n)
+	}
+	if n := c.connectFailures.Load(); n != 0 {
+		t.Fatalf("%d failures after connecting, want 0", n)
+	}
+}
+
+func TestOnRefresh(t *testing.T) {
+	chrome := newFakeChrome(t, cookieHandlers(&Cookie{Name: "sid", Value: "abc", Domain: "example.com", Path: "/"}))
+
+	var c *client
+	var snapshot []*http.Cookie
+	var refreshed time.Time
+	c = newClient(chrome.debugURL(), 0, WithOnRefresh(func(cookies []*http.Cookie, at time.Time) {
+		snapshot = c.SnapshotCookies() // must not deadlock
+		refreshed = at
+	}))
+	defer c.Close()
+
+	if err := c.RefreshCookies(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshot) != 1 || snapshot[0].Value != "abc" {
+		t.Fatalf("snapshot in callback = %v, want sid=abc", snapshot)
+	}
+	if refreshed.IsZero() {
+		t.Fatal("refresh time not passed")
+	}
+}
+
+func TestTargetFilter(t *testing.T) {
+	chrome := newFakeChrome(t, cookieHandlers())
+	for _, id := range []string{"a", "b"} {
+		chrome.targets = append(chrome.targets, Target{
+			ID:                   id,
+			Type:                 "page",
+			URL:                  "https://" + id + ".example.com/",
+			WebSocketDebuggerURL: chrome.debugURL() + "/devtools/page/" + id,
+		})
+	}
+
+	targets, err := ListTargets(context.Background(), chrome.debugURL())
+	if err != nil || len(targets) != 2 {
+		t.Fatalf("ListTargets = %v, %v", targets, err)
+	}
+
+	c := newClient(chrome.debugURL(), 0, WithTargetFilter(func(t Target) bool {
+		return strings.HasPrefix(t.URL, "https://b.")
+	}))
+	defer c.Close()
+	if err := c.RefreshCookies(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if path := chrome.lastPath.Load(); path != "/devtools/page/b" {
+		t.Fatalf("connected to %v, want /devtools/page/b", path)
+	}
+
+	none := newClient(chrome.debugURL(), 0, WithTargetFilter(func(Target) bool { return false }))
+	defer none.Close()
+	if _, err := none.AwaitConnection(context.Background(), 1); err == nil {
+		t.Fatal("connected without a matching target")
+	}
+}
+
+func TestPreferTarget(t *testing.T) {
+	chrome := newFakeChrome(t, cookieHandlers())
+	pages := []Target{
+		{ID: "sw", Type: "service_worker", WebSocketDebuggerURL: chrome.debugURL() + "/devtools/worker/sw"},
+		{ID: "attached", Type: "page"}, // no websocket URL while attached elsewhere
+		{ID: "a", Type: "page", WebSocketDebuggerURL: chrome.debugURL() + "/devtools/page/a"},
+		{ID: "b", Type: "page", WebSocketDebuggerURL: chrome.debugURL() + "/devtools/page/b"},
+	}
+
+	for _, tt := range []struct {
+		name    string
+		targets []Target
+		opts    []Option
+		want    string
+	}{
+		{"default", pages, nil, "/devtools/browser/fake"},
+		{"prefer browser", pages, []Option{WithPreferBrowser()}, "/devtools/browser/fake"},
+		{"prefer target", pages, []Option{WithPreferTarget()}, "/devtools/page/a"},
+		{"last option wins", pages, []Option{WithPreferTarget(), WithPreferBrowser()}, "/devtools/browser/fake"},
+		{"no page", pages[:2], []Option{WithPreferTarget()}, "/devtools/browser/fake"},
+	} {
+		chrome.targets = tt.targets
+		for range 3 {
+			c := newClient(chrome.debugURL(), 0, tt.opts...)
+			err := c.RefreshCookies(context.Background())
+			c.Close()
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			if path := chrome.lastPath.Load(); path != tt.want {
+				t.Fatalf("%s: connected to %v, want %s", tt.name, path, tt.want)
+			}
+		}
+	}
+}
+
+func TestListTargetsDeadline(t *testing.T) {
+	chrome := newFakeChrome(t, cookieHandlers())
+
+	var deadlines []time.Duration
+	opts := &dialOptions{keepHost: true, httpClient: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if deadline, ok := req.Context().Deadline(); ok {
+			deadlines = append(deadlines, time.Until(deadline))
+		}
+		return http.DefaultTransport.RoundTrip(req)
+	})}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if _, err := listTargets(ctx, opts, chrome.debugURL()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listTargets(context.Background(), opts, chrome.debugURL()); err != nil {
+		t.Fatal(err)
+	}
+	if len(deadlines) != 2 || deadlines[0] <= 5*time.Second || deadlines[1] > 5*time.Second {
+		t.Fatalf("deadlines = %v, want the caller's minute, then the 5s default", deadlines)
+	}
+}
+
+func TestNavigate(t *testing.T) {
+	handlers := cookieHandlers()
+	handlers["Page.enable"] = func(json.RawMessage) (any, error) {
+		return struct{}{}, nil
+	}
+	handlers["Page.navigate"] = func(params json.RawMessage) (any, error) {
+		var p struct {
+			URL string `json:"url"`
+		}
+		json.Unmarshal(params, &p)
+		if p.URL == "https://bad.example/" {
+			return navigateResponse{FrameID: "f", ErrorText: "net::ERR_NAME_NOT_RESOLVED"}, nil
+		}
+		return fakeResultWithEvents{
+			Result: navigateResponse{FrameID: "f", LoaderID: "l"},
+			Events: []fakeEvent{
+				{Method: "Page.domContentEventFired", Params: map[string]float64{"timestamp": 1}},
+				{Method: "Page.loadEventFired", Params: map[string]float64{"timestamp": 2}},
+			},
+		}, nil
+	}
+	chrome := newFakeChrome(t, handlers)
+
+	c := newClient(chrome.debugURL(), 0)
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Navigate(ctx, "https://example.com/login"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Navigate(ctx, "https://bad.example/"); err == nil || !strings.Contains(err.Error(), "ERR_NAME_NOT_RESOLVED") {
+		t.Fatalf("Navigate error = %v, want ERR_NAME_NOT_RESOLVED", err)
+	}
+}
+
+func TestCommandTimeout(t *testing.T) {
+	handlers := cookieHandlers()
+	handlers["Slow"] = func(json.RawMessage) (any, error) {
+		time.Sleep(100 * time.Millisecond)
+		return struct{}{}, nil
+	}
+	chrome := newFakeChrome(t, handlers)
+
+	for _, tt := range []struct {
+		timeout time.Duration
+		wantErr bool
+	}{{20 * time.Millisecond, true}, {0, false}} {
+		c := newClient(chrome.debugURL(), 0, WithCommandTimeout(tt.timeout))
+		cdp, _ := c.ensureConnection(context.Background())
+		_, err := cdp.execute(context.Background(), "Slow", nil)
+		if tt.wantErr != errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("timeout %v: error = %v", tt.timeout, err)
+		}
+		c.Close()
+	}
+}
+
+func TestLateResponseAfterTimeout(t *testing.T) {
+	handlers := cookieHandlers()
+	handlers["Slow"] = func(json.RawMessage) (any, error) {
+		time.Sleep(100 * time.Millisecond)
+		return struct{}{}, nil
+	}
+	chrome := newFakeChrome(t, handlers)
+
+	unmatched := make(chan int64, 1)
+	c := newClient(chrome.debugURL(), 0, WithCommandTimeout(20*time.Millisecond), WithOnUnmatchedResponse(func(id int64, message []byte) {
+		unmatched <- id
+	}))
+	defer c.Close()
+	cdp, _ := c.ensureConnection(context.Background())
+
+	if _, err := cdp.execute(context.Background(), "Slow", nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Slow: error = %v", err)
+	}
+	cdp.commandTimeout = time.Second
+	if _, err := cdp.execute(context.Background(), "Browser.getVersion", nil); err != nil {
+		t.Fatalf("command after timeout: %v", err)
+	}
+	select {
+	case id := <-unmatched:
+		if id != 1 {
+			t.Fatalf("unmatched id = %d, want 1", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("late response not reported")
+	}
+	cdp.pendingMu.Lock()
+	n := len(cdp.pending)
+	cdp.pendingMu.Unlock()
+	if n != 0 {
+		t.Fatalf("%d pending commands left", n)
+	}
+}
+
+func TestExecute(t *testing.T) {
+	handlers := cookieHandlers()
+	handlers["Runtime.evaluate"] = func(params json.RawMessage) (any, error) {
+		return map[string]any{"result": map[string]any{"type": "number", "value": 2}}, nil
+	}
+	chrome := newFakeChrome(t, handlers)
+
+	c := newClient(chrome.debugURL(), 0)
+	defer c.Close()
+
+	result, err := c.Execute(context.Background(), "Runtime.evaluate", map[string]string{"expression": "1+1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result) != `{"result":{"type":"number","value":2}}` {
+		t.Fatalf("result = %s", result)
+	}
+}
+
+func TestExecuteInvalidParams(t *testing.T) {
+	handlers := cookieHandlers()
+	handlers["Runtime.evaluate"] = func(json.RawMessage) (any, error) {
+		return map[string]any{}, nil
+	}
+	chrome := newFakeChrome(t, handlers)
+
+	var recorded strings.Builder
+	c := newClient(chrome.debugURL(), 0, WithRecorder(&recorded))
+	defer c.Close()
+
+	if _, err := c.Execute(context.Background(), "Runtime.evaluate", map[string]any{"x": math.NaN()}); err == nil {
+		t.Fatal("expected an error for unencodable params")
+	}
+	if !strings.Contains(recorded.String(), "unsupported value") {
+		t.Errorf("recording = %q, want the encoding error", recorded.String())
+	}
+
+	// The connection is still usable
+	if _, err := c.Execute(context.Background(), "Runtime.evaluate", map[string]any{"x": 1}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAdaptiveTimeoutWidensAfterTimeout(t *testing.T) {
+	var slow atomic.Bool
+	handlers := cookieHandlers(&Cookie{Name: "sid", Value: "abc", Domain: "example.com", Path: "/"})
+	getCookies := handlers["Storage.getCookies"]
+	handlers["Storage.getCookies"] = func(params json.RawMessage) (any, error) {
+		if slow.Load() {
+			time.Sleep(150 * time.Millisecond)
+		}
+		return getCookies(params)
+	}
+	chrome := newFakeChrome(t, handlers)
+
+	c := newClient(chrome.debugURL(), 0, WithAdaptiveTimeout(20*time.Millisecond, 2*time.Second))
+	defer c.Close()
+
+	for range 20 {
+		if err := c.RefreshCookies(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := c.adaptiveTimeout.timeout(); got != 20*time.Millisecond {
+		t.Fatalf("timeout after fast fetches = %v, want 20ms", got)
+	}
+
+	// The first attempt times out; the retry after reconnecting gets a
+	// widened timeout
+	slow.Store(true)
+	if err := c.RefreshCookies(context.Background()); err != nil {
+		t.Fatalf("refresh after Chrome slowed down: %v", err)
+	}
+	if got := c.adaptiveTimeout.timeout(); got <= 150*time.Millisecond {
+		t.Fatalf("timeout after slow fetches = %v, want more than 150ms", got)
+	}
+}
+
+func TestRecorderRedacts(t *testing.T) {
+	handlers := cookieHandlers(&Cookie{Name: "sid", Value: "SECRET1", Domain: "example.com", Path: "/"})
+	handlers["Network.setCookie"] = func(json.RawMessage) (any, error) {
+		return map[string]any{"success": true}, nil
+	}
+	handlers["Runtime.evaluate"] = func(json.RawMessage) (any, error) {
+		return map[string]any{"result": map[string]any{"type": "string", "value": "SECRET3"}}, nil
+	}
+	handlers["DOMStorage.enable"] = func(json.RawMessage) (any, error) { return struct{}{}, nil }
+	handlers["DOMStorage.getDOMStorageItems"] = func(json.RawMessage) (any, error) {
+		return map[string]any{"entries": [][]string{{"token", "SECRET4"}}}, nil
+	}
+	chrome := newFakeChrome(t, handlers)
+
+	for _, record := range []bool{false, true} {
+		var recorded strings.Builder
+		c := newClient(chrome.debugURL(), 0, WithRecorder(&recorded), WithRecordCookieValues(record))
+		ctx := context.Background()
+		if err := c.RefreshCookies(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.Execute(ctx, "Network.setCookie", map[string]any{"name": "sid", "value": "SECRET2", "domain": "example.com"}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.Execute(ctx, "Runtime.evaluate", map[string]any{"expression": "document.title"}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.LocalStorage(ctx, "https://example.com"); err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+
+		for _, secret := range []string{"SECRET1", "SECRET2", "SECRET3", "SECRET4"} {
+			if got := strings.Contains(recorded.String(), secret); got != record {
+				t.Errorf("record values %v: recording contains %s = %v", record, secret, got)
+			}
+		}
+	}
+}
+
+func TestResolver(t *testing.T) {
+	var used atomic.Bool
+	r := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			used.Store(true)
+			return nil, errors.New("cluster DNS unreachable")
+		},
+	}
+
+	c := newClient("ws://headless-shell.cluster.test:9222", 0, WithResolver(r))
+	defer c.Close()
+	if _, err := c.AwaitConnection(context.Background(), 1); err == nil {
+		t.Fatal("connected without DNS")
+	}
+	if !used.Load() {
+		t.Fatal("custom resolver not used")
+	}
+}
+
+func TestSelectAddress(t *testing.T) {
+	v4, v6 := net.IPAddr{IP: net.ParseIP("10.0.0.1")}, net.IPAddr{IP: net.ParseIP("fd00::1")}
+	tests := []struct {
+		addrs  []net.IPAddr
+		family AddressFamily
+		want   string
+	}{
+		{[]net.IPAddr{v6, v4}, PreferIPv4, "10.0.0.1"},
+		{[]net.IPAddr{v4, v6}, PreferIPv6, "fd00::1"},
+		{[]net.IPAddr{v6, v4}, FirstAddress, "fd00::1"},
+		{[]net.IPAddr{v6}, PreferIPv4, "fd00::1"},
+		{[]net.IPAddr{v4}, PreferIPv6, "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		if got := selectAddress(tt.addrs, tt.family).String(); got != tt.want {
+			t.Errorf("selectAddress(%v, %d) = %s, want %s", tt.addrs, tt.family, got, tt.want)
+		}
+	}
+}
+
+func TestHTTPClient(t *testing.T) {
+	chrome := newFakeChrome(t, cookieHandlers())
+
+	var paths []string
+	hc := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		paths = append(paths, req.URL.Path)
+		return http.DefaultTransport.RoundTrip(req)
+	})}
+	c := newClient(chrome.debugURL(), 0, WithHTTPClient(hc))
+	defer c.Close()
+
+	if err := c.RefreshCookies(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(paths, " ") != "/json/version /devtools/browser/fake" {
+		t.Fatalf("requests through client: %q", paths)
+	}
+}
+
+func TestKeepaliveDetectsDeadConnection(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	handlers := cookieHandlers()
+	handlers["Hang"] = func(json.RawMessage) (any, error) {
+		<-release // stop reading, so pings go unanswered
+		return struct{}{}, nil
+	}
+	chrome := newFakeChrome(t, handlers)
+
+	c := newClient(chrome.debugURL(), 0, WithKeepalive(20*time.Millisecond), WithCommandTimeout(0))
+	defer c.Close()
+	cdp, _ := c.ensureConnection(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := cdp.execute(ctx, "Hang", nil); err == nil || errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("execute error = %v, want connection failure", err)
+	}
+	if !cdp.dead.Load() {
+		t.Fatal("connection not marked dead")
+	}
+}
+
+func TestTypedErrors(t *testing.T) {
+	down := newClient("ws://127.0.0.1:1", 0, WithConnectRetries(0))
+	defer down.Close()
+	err := down.RefreshCookies(context.Background())
+	var connectErr *ConnectError
+	if !errors.Is(err, ErrChromeUnavailable) || !errors.As(err, &connectErr) {
+		t.Fatalf("RefreshCookies error = %v, want ErrChromeUnavailable and *ConnectError", err)
+	}
+
+	chrome := newFakeChrome(t, cookieHandlers())
+	c := newClient(chrome.debugURL(), 0)
+	defer c.Close()
+	_, err = c.Execute(context.Background(), "Legacy.method", nil)
+	var cdpErr *CDPError
+	if !errors.As(err, &cdpErr) || cdpErr.Code != -32601 || cdpErr.Method != "Legacy.method" {
+		t.Fatalf("Execute error = %v, want *CDPError with code -32601 from Legacy.method", err)
+	}
+}
+
+func TestSetCookies(t *testing.T) {
+	var got []cookieParam
+	handlers := cookieHandlers()
+	handlers["Storage.setCookies"] = func(params json.RawMessage) (any, error) {
+		var p struct {
+			Cookies []cookieParam `json:"cookies"`
+		}
+		err := json.Unmarshal(params, &p)
+		got = p.Cookies
+		return struct{}{}, err
+	}
+	chrome := newFakeChrome(t, handlers)
+
+	c := newClient(chrome.debugURL(), 0)
+	defer c.Close()
+
+	orphan := &http.Cookie{Name: "orphan", Value: "1"}
+	err := c.SetCookies(context.Background(), []*http.Cookie{
+		{Name: "sid", Value: "abc", Domain: ".example.com", Path: "/app", Secure: true},
+		{Name: "pref", Value: "1", Domain: "www.example.com"},
+		orphan,
+	})
+	var rejected *CookiesRejectedError
+	if !errors.As(err, &rejected) || len(rejected.Cookies) != 1 || rejected.Cookies[0] != orphan {
+		t.Fatalf("SetCookies error = %v, want the cookie without a domain rejected", err)
+	}
+	want := []cookieParam{
+		{Name: "sid", Value: "abc", URL: "https://example.com/app", Domain: ".example.com", Path: "/app", Secure: true},
+		{Name: "pref", Value: "1", URL: "http://www.example.com/", Domain: "www.example.com", Path: "/"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Storage.setCookies params = %+v, want %+v", got, want)
+	}
+}
+
+func TestSetCookiesMaxAge(t *testing.T) {
+	var got []cookieParam
+	handlers := cookieHandlers()
+	handlers["Storage.setCookies"] = func(params json.RawMessage) (any, error) {
+		var p struct {
+			Cookies []cookieParam `json:"cookies"`
+		}
+		err := json.Unmarshal(params, &p)
+		got = p.Cookies
+		return struct{}{}, err
+	}
+	chrome := newFakeChrome(t, handlers)
+
+	c := newClient(chrome.debugURL(), 0)
+	defer c.Close()
+	err := c.SetCookies(context.Background(), []*http.Cookie{
+		{Name: "deleted", Value: "1", Domain: "example.com", MaxAge: -1},
+		{Name: "minute", Value: "1", Domain: "example.com", MaxAge: 60},
+		{Name: "session", Value: "1", Domain: "example.com"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 3 {
+		t.Fatalf("Storage.setCookies params = %+v, want 3 cookies", got)
+	}
+	if expires := got[0].Expires; expires <= 0 || expires > float64(time.Now().Unix()) {
+		t.Errorf("MaxAge < 0: expires = %v, want a time in the past", expires)
+	}
+	if d := time.Until(time.Unix(int64(got[1].Expires), 0)); d < 55*time.Second || d > time.Minute {
+		t.Errorf("MaxAge 60: expires in %v, want about a minute", d)
+	}
+	if got[2].Expires != 0 {
+		t.Errorf("session cookie: expires = %v, want none", got[2].Expires)
+	}
+}
+
+func TestSetCookiesForURL(t *testing.T) {
+	var got []cookieParam
+	handlers := cookieHandlers()
+	handlers["Storage.setCookies"] = func(params json.RawMessage) (any, error) {
+		var p struct {
+			Cookies []cookieParam `json:"cookies"`
+		}
+		err := json.Unmarshal(params, &p)
+		got = p.Cookies
+		return struct{}{}, err
+	}
+	chrome := newFakeChrome(t, handlers)
+
+	c := newClient(chrome.debugURL(), 0)
+	defer c.Close()
+
+	expires := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	err := c.SetCookiesForURL(context.Background(), "https://app.example.com/login", []*http.Cookie{
+		{Name: "sid", Value: "abc", Domain: ".example.com", Secure: true, Expires: expires},
+		{Name: "csrf", Value: "x"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []cookieParam{
+		{Name: "sid", Value: "abc", URL: "https://example.com/", Domain: ".example.com", Path: "/", Secure: true, Expires: float64(expires.Unix())},
+		{Name: "csrf", Value: "x", URL: "http://app.example.com/", Path: "/"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Storage.setCookies params = %+v, want %+v", got, want)
+	}
+}
+
+func TestProtocolVersion(t *testing.T) {
+	handlers := cookieHandlers()
+	handlers["Browser.getVersion"] = func(json.RawMessage) (any, error) {
+		return BrowserVersion{ProtocolVersion: "1.3", UserAgent: "FakeChrome/1.0"}, nil
+	}
+	chrome := newFakeChrome(t, handlers)
+
+	c := newClient(chrome.debugURL(), 0)
+	defer c.Close()
+	if v := c.ProtocolVersion(); v != "" {
+		t.Fatalf("ProtocolVersion before connecting = %q", v)
+	}
+	if err := c.RefreshCookies(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if v := c.ProtocolVersion(); v != "1.3" {
+		t.Fatalf("ProtocolVersion = %q, want 1.3", v)
+	}
+}
+
+func TestSetCookiesPartitionKeyFallback(t *testing.T) {
+	for _, rejectKeys := range []bool{false, true} {
+		var calls [][]cookieParam
+		handlers := cookieHandlers()
+		handlers["Storage.setCookies"] = func(params json.RawMessage) (any, error) {
+			var p struct {
+				Cookies []cookieParam `json:"cookies"`
+			}
+			if err := json.Unmarshal(params, &p); err != nil {
+				return nil, err
+			}
+			calls = append(calls, p.Cookies)
+			if rejectKeys && p.Cookies[0].PartitionKey != nil {
+				return nil, &CDPError{Code: cdpInvalidParams, Message: "Invalid parameters"}
+			}
+			return struct{}{}, nil
+		}
+		chrome := newFakeChrome(t, handlers)
+
+		c := newClient(chrome.debugURL(), 0)
+		for range 2 {
+			err := c.SetCookies(context.Background(), []*http.Cookie{
+				{Name: "chips", Value: "1", Domain: "example.com", Secure: true, Partitioned: true},
+			})
+			if err != nil {
+				t.Fatalf("rejecting keys %v: %v", rejectKeys, err)
+			}
+		}
+		c.Close()
+
+		var keys []*CookiePartitionKey
+		for _, call := range calls {
+			keys = append(keys, call[0].PartitionKey)
+		}
+		want := []*CookiePartitionKey{{TopLevelSite: "https://example.com"}, {TopLevelSite: "https://example.com"}}
+		if rejectKeys {
+			// Rejected once, then sent without the key
+			want = []*CookiePartitionKey{want[0], nil, nil}
+		}
+		if !reflect.DeepEqual(keys, want) {
+			t.Errorf("rejecting keys %v: sent partition keys %v, want %v", rejectKeys, keys, want)
+		}
+	}
+}
+
+func TestClearAndDeleteCookies(t *testing.T) {
+	var deleted []cookieParam
+	handlers := cookieHandlers(
+		&Cookie{Name: "sid", Value: "abc", Domain: "example.com", Path: "/"},
+		&Cookie{Name: "pref", Value: "1", Domain: ".example.com", Path: "/"},
+	)
+	handlers["Storage.clearCookies"] = func(json.RawMessage) (any, error) {
+		return struct{}{}, nil
+	}
+	handlers["Storage.setCookies"] = func(params json.RawMessage) (any, error) {
+		var p struct {
+			Cookies []cookieParam `json:"cookies"`
+		}
+		err := json.Unmarshal(params, &p)
+		deleted = p.Cookies
+		return struct{}{}, err
+	}
+	chrome := newFakeChrome(t, handlers)
+
+	c := newClient(chrome.debugURL(), 0, WithInitialCookies([]*http.Cookie{
+		{Name: "seeded", Value: "1", Domain: "other.example", Path: "/"},
+	}))
+	defer c.Close()
+	ctx := context.Background()
+	u := &url.URL{Scheme: "https", Host: "example.com", Path: "/"}
+	seeded := &url.URL{Scheme: "https", Host: "other.example", Path: "/"}
+
+	if err := c.RefreshCookies(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.DeleteCookie(ctx, "sid", "https://example.com/"); err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 1 || deleted[0].URL != "https://example.com/" || deleted[0].Expires != 1 {
+		t.Fatalf("expired cookies set = %+v, want sid for https://example.com/", deleted)
+	}
+	if got := c.Jar.Cookies(u); len(got) != 1 || got[0].Name != "pref" {
+		t.Fatalf("jar after DeleteCookie = %v, want pref", got)
+	}
+
+	if got := c.Jar.Cookies(seeded); len(got) != 1 {
+		t.Fatalf("seeded cookies = %v, want seeded", got)
+	}
+
+	if err := c.ClearCookies(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.Jar.Cookies(u); len(got) != 0 {
+		t.Fatalf("jar after ClearCookies = %v, want none", got)
+	}
+	if got := c.Jar.Cookies(seeded); len(got) != 0 {
+		t.Fatalf("seeded cookies after ClearCookies = %v, want none", got)
+	}
+	if c.CacheValid() {
+		t.Fatal("cache still valid after ClearCookies")
+	}
+}
+
+func TestLocalStorage(t *testing.T) {
+	handlers := cookieHandlers()
+	handlers["DOMStorage.enable"] = func(json.RawMessage) (any, error) {
+		return struct{}{}, nil
+	}
+	handlers["DOMStorage.getDOMStorageItems"] = func(params json.RawMessage) (any, error) {
+		var p struct {
+			StorageID struct {
+				SecurityOrigin string `json:"securityOrigin"`
+				IsLocalStorage bool   `json:"isLocalStorage"`
+			} `json:"storageId"`
+		}
+		json.Unmarshal(params, &p)
+		if p.StorageID.SecurityOrigin != "https://example.com" || !p.StorageID.IsLocalStorage {
+			return nil, fmt.Errorf("unexpected storage id %+v", p.StorageID)
+		}
+		return getDOMStorageItemsResponse{Entries: [][]string{{"token", "bearer-abc"}, {"theme", "dark"}}}, nil
+	}
+	chrome := newFakeChrome(t, handlers)
+
+	c := newClient(chrome.debugURL(), 0)
+	defer c.Close()
+
+	items, err := c.LocalStorage(context.Background(), "https://example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"token": "bearer-abc", "theme": "dark"}; !reflect.DeepEqual(items, want) {
+		t.Fatalf("LocalStorage = %v, want %v", items, want)
+	}
+}
+
+func TestAllContextsCookies(t *testing.T) {
+	handlers := cookieHandlers()
+	handlers["Target.getBrowserContexts"] = func(json.RawMessage) (any, error) {
+		return map[string]any{"browserContextIds": []string{"incognito"}}, nil
+	}
+	handlers["Storage.getCookies"] = func(params json.RawMessage) (any, error) {
+		var p struct {
+			BrowserContextID string `json:"browserContextId"`
+		}
+		if len(params) > 0 {
+			json.Unmarshal(params, &p)
+		}
+		name := "default"
+		if p.BrowserContextID != "" {
+			name = p.BrowserContextID
+		}
+		return getCookiesResponses{Cookies: []*Cookie{{Name: name, Value: "1", Domain: "example.com", Path: "/"}}}, nil
+	}
+	chrome := newFakeChrome(t, handlers)
+
+	c := newClient(chrome.debugURL(), 0)
+	defer c.Close()
+
+	names := func(cookies []*http.Cookie) []string {
+		var names []string
+		for _, cookie := range cookies {
+			names = append(names, cookie.Name)
+		}
+		return names
+	}
+	cookies, err := c.DefaultContextCookies(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(cookies); !slices.Equal(got, []string{"default"}) {
+		t.Errorf("DefaultContextCookies = %v, want [default]", got)
+	}
+	cookies, err = c.AllContextsCookies(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(cookies); !slices.Equal(got, []string{"default", "incognito"}) {
+		t.Errorf("AllContextsCookies = %v, want [default incognito]", got)
+	}
+}
+
+func TestOnStale(t *testing.T) {
+	chrome := newFakeChrome(t, cookieHandlers(&Cookie{Name: "sid", Value: "abc", Domain: "example.com", Path: "/"}))
+	seed := WithInitialCookies([]*http.Cookie{{Name: "sid", Value: "abc", Domain: "example.com", Path: "/"}})
+
+	var ages []time.Duration
+	onStale := WithOnStale(func(age time.Duration) { ages = append(ages, age) })
+
+	healthy := newClient(chrome.debugURL(), time.Hour, seed, onStale)
+	if err := healthy.RefreshCookies(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	healthy.Close()
+	if len(ages) != 0 {
+		t.Fatalf("onStale called %d times while Chrome is available", len(ages))
+	}
+
+	down := newClient("ws://127.0.0.1:1", time.Hour, seed, onStale, WithConnectRetries(0))
+	defer down.Close()
+	time.Sleep(10 * time.Millisecond)
+	if err := down.RefreshCookies(context.Background()); err != nil {
+		t.Fatalf("refresh with valid cache = %v, want nil", err)
+	}
+	if len(ages) != 1 || ages[0] < 10*time.Millisecond || ages[0] > time.Minute {
+		t.Fatalf("onStale ages = %v, want one age of at least 10ms", ages)
+	}
+}
+
+func TestName(t *testing.T) {
+	chrome := newFakeChrome(t, cookieHandlers(&Cookie{Name: "sid", Value: "abc", Domain: "example.com", Path: "/"}))
+
+	var recorded, logged strings.Builder
+	logger := slog.New(slog.NewTextHandler(&logged, nil))
+	c := newClient(chrome.debugURL(), 0, WithName("eu-1"), WithRecorder(&recorded), WithLogger(logger))
+	if c.Name() != "eu-1" {
+		t.Fatalf("Name() = %q, want eu-1", c.Name())
+	}
+	if err := c.RefreshCookies(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	for _, line := range strings.Split(strings.TrimSpace(recorded.String()), "\n") {
+		var entry recordEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry.Name != "eu-1" {
+			t.Errorf("recorded %s with name %q, want eu-1", entry.Method, entry.Name)
+		}
+	}
+	if !strings.Contains(logged.String(), "client=eu-1") {
+		t.Errorf("log lacks client=eu-1:\n%s", logged.String())
+	}
+}
+
+func TestRefreshDelta(t *testing.T) {
+	var mu sync.Mutex
+	cookies := []*Cookie{
+		{Name: "keep", Value: "1", Domain: "example.com", Path: "/"},
+		{Name: "change", Value: "old", Domain: "example.com", Path: "/"},
+		{Name: "remove", Value: "1", Domain: "example.com", Path: "/"},
+	}
+	handlers := cookieHandlers()
+	handlers["Storage.getCookies"] = func(json.RawMessage) (any, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return getCookiesResponses{Cookies: cookies}, nil
+	}
+	chrome := newFakeChrome(t, handlers)
+
+	c := newClient(chrome.debugURL(), 0)
+	defer c.Close()
+	ctx := context.Background()
+
+	delta, err := c.RefreshDelta(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(delta.Added) != 3 || len(delta.Changed) != 0 || len(delta.Removed) != 0 {
+		t.Fatalf("first delta = %+v, want all cookies added", delta)
+	}
+
+	delta, err = c.RefreshDelta(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !delta.Empty() {
+		t.Fatalf("delta without changes = %+v, want empty", delta)
+	}
+
+	mu.Lock()
+	cookies = []*Cookie{
+		{Name: "keep", Value: "1", Domain: "example.com", Path: "/"},
+		{Name: "change", Value: "new", Domain: "example.com", Path: "/"},
+		{Name: "add", Value: "1", Domain: "example.com", Path: "/"},
+	}
+	mu.Unlock()
+	delta, err = c.RefreshDelta(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(delta.Added) != 1 || delta.Added[0].Name != "add" ||
+		len(delta.Changed) != 1 || delta.Changed[0].Value != "new" ||
+		len(delta.Removed) != 1 || delta.Removed[0].Name != "remove" {
+		t.Fatalf("delta = %+v, want add added, change changed and remove removed", delta)
+	}
+
+	parts := strings.Split(c.CookieHeader(&url.URL{Scheme: "http", Host: "example.com", Path: "/"}), "; ")
+	slices.Sort(parts)
+	if got := strings.Join(parts, "; "); got != "add=1; change=new; keep=1" {
+		t.Fatalf("jar after delta = %q", got)
+	}
+}
+
+func TestWebSocketURL(t *testing.T) {
+	chrome := newFakeChrome(t, cookieHandlers(&Cookie{Name: "sid", Value: "abc", Domain: "example.com", Path: "/"}))
+
+	// The debug URL is unreachable; only the websocket URL is used
+	c := newClient("ws://127.0.0.1:1", 0, WithWebSocketURL(chrome.debugURL()+"/devtools/browser/known"))
+	defer c.Close()
+	if err := c.RefreshCookies(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if path := chrome.lastPath.Load(); path != "/devtools/browser/known" {
+		t.Fatalf("websocket path = %v, want /devtools/browser/known", path)
+	}
+}
+
+func TestOrigin(t *testing.T) {
+	chrome := newFakeChrome(t, cookieHandlers(&Cookie{Name: "sid", Value: "abc", Domain: "example.com", Path: "/"}))
+	chrome.origins = []string{"allowed.example"}
+
+	for origin, wantErr := range map[string]bool{
+		"http://allowed.example": false,
+		"http://other.example":   true,
+	} {
+		c := newClient(chrome.debugURL(), 0, WithOrigin(origin), WithConnectRetries(0))
+		err := c.RefreshCookies(context.Background())
+		c.Close()
+		if (err != nil) != wantErr {
+			t.Errorf("origin %s: error = %v, want error %v", origin, err, wantErr)
+		}
+	}
+}
+
+func TestSnapshotCookiesConsistent(t *testing.T) {
+	var generation atomic.Int64
+	handlers := cookieHandlers()
+	handlers["Storage.getCookies"] = func(json.RawMessage) (any, error) {
+		value := strconv.FormatInt(generation.Add(1), 10)
+		cookies := make([]*Cookie, 20)
+		for i := range cookies {
+			cookies[i] = &Cookie{Name: "c" + strconv.Itoa(i), Value: value, Domain: "example.com", Path: "/"}
+		}
+		return getCookiesResponses{Cookies: cookies}, nil
+	}
+	chrome := newFakeChrome(t, handlers)
+
+	c := newClient(chrome.debugURL(), 0)
+	defer c.Close()
+	if err := c.RefreshCookies(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range 10 {
+			c.RefreshCookies(context.Background())
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		snapshot := c.SnapshotCookies()
+		if len(snapshot) != 20 {
+			t.Fatalf("snapshot has %d cookies, want 20", len(snapshot))
+		}
+		for _, cookie := range snapshot {
+			if cookie.Value != snapshot[0].Value {
+				t.Fatalf("torn snapshot mixes refreshes %s and %s", snapshot[0].Value, cookie.Value)
+			}
+		}
+	}
+}
+
+func TestSnapshotCookiesIncludesImported(t *testing.T) {
+	chrome := newFakeChrome(t, cookieHandlers(
+		&Cookie{Name: "sid", Value: "chrome", Domain: ".example.com", Path: "/"},
+		&Cookie{Name: "live", Value: "1", Domain: "example.com", Path: "/"},
+	))
+
+	c := newClient(chrome.debugURL(), 0, WithInitialCookies([]*http.Cookie{
+		{Name: "sid", Value: "seeded", Domain: "example.com", Path: "/"},
+		{Name: "saved", Value: "1", Domain: "example.com", Path: "/"},
+	}))
+	defer c.Close()
+	export := `[{"domain": "other.example", "hostOnly": true, "name": "imported", "path": "/", "session": true, "value": "1"}]`
+	if err := c.ImportChromeExtensionJSON(strings.NewReader(export)); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot := func() []string {
+		var got []string
+		for _, cookie := range c.SnapshotCookies() {
+			got = append(got, cookie.Name+"="+cookie.Value)
+		}
+		slices.Sort(got)
+		return got
+	}
+	if got, want := snapshot(), []string{"imported=1", "saved=1", "sid=seeded"}; !slices.Equal(got, want) {
+		t.Errorf("snapshot before refresh = %q, want %q", got, want)
+	}
+
+	// Chrome's sid replaces the seeded one in the jar, and so in snapshots
+	if err := c.RefreshCookies(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := snapshot(), []string{"imported=1", "live=1", "saved=1", "sid=chrome"}; !slices.Equal(got, want) {
+		t.Errorf("snapshot after refresh = %q, want %q", got, want)
+	}
+}
+
+func TestMaxExpiry(t *testing.T) {
+	soon := time.Now().Add(10 * time.Minute).Truncate(time.Second)
+	chrome := newFakeChrome(t, cookieHandlers(
+		&Cookie{Name: "far", Value: "1", Domain: "example.com", Path: "/", Expires: 253402300799},
+		&Cookie{Name: "soon", Value: "1", Domain: "example.com", Path: "/", Expires: float64(soon.Unix())},
+		&Cookie{Name: "session", Value: "1", Domain: "example.com", Path: "/", Session: true, Expires: -1},
+	))
+
+	c := newClient(chrome.debugURL(), 0, WithMaxExpiry(time.Hour))
+	defer c.Close()
+	cookies, err := c.DefaultContextCookies(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	limit := time.Now().Add(time.Hour)
+	for _, cookie := range cookies {
+		switch cookie.Name {
+		case "far":
+			if d := cookie.Expires.Sub(limit); d < -time.Minute || d > time.Second {
+				t.Errorf("far Expires = %v, want clamped to about %v", cookie.Expires, limit)
+			}
+			if cookie.MaxAge > 3600 {
+				t.Errorf("far MaxAge = %d, want at most an hour", cookie.MaxAge)
+			}
+		case "soon":
+			if !cookie.Expires.Equal(soon) {
+				t.Errorf("soon Expires = %v, want %v unchanged", cookie.Expires, soon)
+			}
+		case "session":
+			if !cookie.Expires.IsZero() {
+				t.Errorf("session Expires = %v, want none", cookie.Expires)
+			}
+		}
+	}
+}
+
+func TestAutoRefreshServesRequests(t *testing.T) {
+	var calls atomic.Int64
+	handlers := cookieHandlers(&Cookie{Name: "sid", Value: "abc", Domain: "example.com", Path: "/"})
+	getCookies := handlers["Storage.getCookies"]
+	handlers["Storage.getCookies"] = func(params json.RawMessage) (any, error) {
+		calls.Add(1)
+		return getCookies(params)
+	}
+	chrome := newFakeChrome(t, handlers)
+
+	e := NewExtractor(chrome.debugURL())
+	defer e.Close()
+	var got *http.Request
+	hc := e.Client(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		got = req
+		return &http.Response{StatusCode: http.StatusNoContent, Body: http.NoBody, Request: req}, nil
+	}))
+
+	e.StartAutoRefresh(context.Background(), 5*time.Millisecond)
+	deadline := time.Now().Add(2 * time.Second)
+	for calls.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no background refresh")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	e.StopAutoRefresh()
+
+	n := calls.Load()
+	if _, err := hc.Get("https://example.com/"); err != nil {
+		t.Fatal(err)
+	}
+	if cookie := got.Header.Get("Cookie"); cookie != "sid=abc" {
+		t.Errorf("Cookie = %q, want sid=abc from the background refresh", cookie)
+	}
+	if refreshes := calls.Load() - n; refreshes != 0 {
+		t.Errorf("request refreshed %d times despite the background refresh", refreshes)
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	var calls atomic.Int64
+	handlers := cookieHandlers(&Cookie{Name: "sid", Value: "abc", Domain: "example.com", Path: "/"})
+	getCookies := handlers["Storage.getCookies"]
+	handlers["Storage.getCookies"] = func(params json.RawMessage) (any, error) {
+		calls.Add(1)
+		return getCookies(params)
+	}
+	chrome := newFakeChrome(t, handlers)
+
+	var got *http.Request
+	c := NewExtractor(chrome.debugURL(), WithCacheTTL(time.Nanosecond))
+	defer c.Close()
+	hc := c.Client(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		got = req
+		return &http.Response{StatusCode: http.StatusNoContent, Body: http.NoBody, Request: req}, nil
+	}))
+	ctx := context.Background()
+	if err := c.RefreshCookies(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	c.Pause()
+	if !c.Paused() {
+		t.Fatal("Paused() = false after Pause")
+	}
+	if err := c.RefreshCookies(ctx); !errors.Is(err, ErrPaused) {
+		t.Fatalf("RefreshCookies while paused = %v, want ErrPaused", err)
+	}
+	c.StartAutoRefresh(ctx, 5*time.Millisecond)
+	if _, err := hc.Get("https://example.com/"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	c.StopAutoRefresh()
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("Chrome asked for cookies %d times while paused, want only the initial refresh", n-1)
+	}
+	if cookie := got.Header.Get("Cookie"); cookie != "sid=abc" {
+		t.Fatalf("Cookie while paused = %q, want the cached sid=abc", cookie)
+	}
+
+	c.Resume()
+	if _, err := hc.Get("https://example.com/"); err != nil {
+		t.Fatal(err)
+	}
+	if n := calls.Load(); n != 2 {
+		t.Fatalf("refreshes after Resume = %d, want 1", n-1)
+	}
+}
+
+func TestIndexedDBValue(t *testing.T) {
+	var requested map[string]any
+	handlers := cookieHandlers()
+	handlers["IndexedDB.requestData"] = func(params json.RawMessage) (any, error) {
+		json.Unmarshal(params, &requested)
+		var entries []any
+		if key := requested["keyRange"].(map[string]any)["lower"].(map[string]any)["string"]; key == "token" {
+			entries = append(entries, map[string]any{
+				"key":        map[string]any{"type": "string", "value": "token"},
+				"primaryKey": map[string]any{"type": "string", "value": "token"},
+				"value":      map[string]any{"type": "string", "value": "eyJhbGciOi"},
+			})
+		}
+		return map[string]any{"objectStoreDataEntries": entries, "hasMore": false}, nil
+	}
+	chrome := newFakeChrome(t, handlers)
+
+	c := newClient(chrome.debugURL(), 0)
+	defer c.Close()
+	ctx := context.Background()
+
+	value, err := c.IndexedDBValue(ctx, "https://app.example.com", "auth", "tokens", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != `"eyJhbGciOi"` {
+		t.Fatalf("value = %s, want the JSON string", value)
+	}
+	if requested["securityOrigin"] != "https://app.example.com" || requested["databaseName"] != "auth" || requested["objectStoreName"] != "tokens" {
+		t.Fatalf("IndexedDB.requestData params = %v", requested)
+	}
+
+	if _, err := c.IndexedDBValue(ctx, "https://app.example.com", "auth", "tokens", "missing"); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Fatalf("missing key error = %v, want not found", err)
+	}
+}
+
+func TestMinExpectedCookies(t *testing.T) {
+	chrome := newFakeChrome(t, cookieHandlers(&Cookie{Name: "sid", Value: "abc", Domain: "example.com", Path: "/"}))
+
+	for n, wantErr := range map[int]bool{1: false, 2: true} {
+		c := newClient(chrome.debugURL(), 0, WithMinExpectedCookies(n))
+		err := c.RefreshCookies(context.Background())
+		c.Close()
+		if wantErr != errors.Is(err, ErrTooFewCookies) {
+			t.Errorf("min %d: error = %v, want ErrTooFewCookies %v", n, err, wantErr)
+		}
+		if wantErr && c.CacheValid() {
+			t.Errorf("min %d: cache valid after too few cookies", n)
+		}
+	}
+}
+
+func TestReconcileOnReconnect(t *testing.T) {
+	chrome := newFakeChrome(t, cookieHandlers(&Cookie{Name: "sid", Value: "abc", Domain: "example.com", Path: "/"}))
+
+	for _, enabled := range []bool{true, false} {
+		c := newClient(chrome.debugURL(), time.Hour, WithReconcileOnReconnect(enabled))
+		ctx := context.Background()
+		if err := c.RefreshCookies(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if c.needsRefresh() {
+			t.Fatalf("enabled %v: refresh needed right after refreshing", enabled)
+		}
+
+		// Reconnect without refreshing
+		c.disconnect()
+		if err := c.Ping(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if got := c.needsRefresh(); got != enabled {
+			t.Errorf("enabled %v: refresh needed after reconnect = %v", enabled, got)
+		}
+		if err := c.RefreshCookies(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if c.needsRefresh() {
+			t.Errorf("enabled %v: refresh still needed after reconciling", enabled)
+		}
+		c.Close()
+	}
+}
+
+func TestLenientJSON(t *testing.T) {
+	handlers := cookieHandlers()
+	handlers["Storage.getCookies"] = func(json.RawMessage) (any, error) {
+		return fakeRawResult(`{"cookies":[` +
+			`{"name":"nan","value":"1","domain":"example.com","path":"/","expires":NaN,"session":false},` +
+			`{"name":"text","value":"2","domain":"example.com","path":"/","expires":"soon","session":false},` +
+			`{"name":"ok","value":"3","domain":"example.com","path":"/","expires":-1,"session":true,"extra":{"x":1}}` +
+			`]}`), nil
+	}
+	chrome := newFakeChrome(t, handlers)
+
+	strict := newClient(chrome.debugURL(), 0, WithCommandTimeout(200*time.Millisecond), WithMaxReconnectsPerRequest(0))
+	if err := strict.RefreshCookies(context.Background()); err == nil {
+		t.Error("strict decoding accepted NaN")
+	}
+	strict.Close()
+
+	var logged strings.Builder
+	c := newClient(chrome.debugURL(), 0, WithLenientJSON(true), WithLogger(slog.New(slog.NewTextHandler(&logged, nil))))
+	defer c.Close()
+	cookies, err := c.RawCDPCookies(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cookies) != 3 {
+		t.Fatalf("got %d cookies, want 3", len(cookies))
+	}
+	for _, cookie := range cookies[:2] {
+		if cookie.Expires != 0 {
+			t.Errorf("%s expires = %v, want 0 for an unparseable value", cookie.Name, cookie.Expires)
+		}
+	}
+	for _, want := range []string{"replaced non-finite numbers", "field=expires"} {
+		if !strings.Contains(logged.String(), want) {
+			t.Errorf("log lacks %q:\n%s", want, logged.String())
+		}
+	}
+}
+
+func TestDevToolsActivePortFile(t *testing.T) {
+	chrome := newFakeChrome(t, cookieHandlers(&Cookie{Name: "sid", Value: "abc", Domain: "example.com", Path: "/"}))
+	_, port, err := net.SplitHostPort(chrome.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := t.TempDir() + "/DevToolsActivePort"
+	if err := os.WriteFile(path, []byte(port+"\n/devtools/browser/random\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	c := newClient("ws://127.0.0.1:1", 0, WithDevToolsActivePortFile(path))
+	defer c.Close()
+	if err := c.RefreshCookies(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := chrome.lastPath.Load(); got != "/devtools/browser/random" {
+		t.Fatalf("websocket path = %v, want /devtools/browser/random", got)
+	}
+
+	for _, content := range []string{"", "notaport\n/devtools/browser/x", port + "\n"} {
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readDevToolsActivePort(path); err == nil {
+			t.Errorf("content %q: no error", content)
+		}
+	}
+}
+
+func TestResponseMatcher(t *testing.T) {
+	chrome := newFakeChrome(t, cookieHandlers(&Cookie{Name: "sid", Value: "abc", Domain: "example.com", Path: "/"}))
+	chrome.wrap = func(message []byte) []byte {
+		return fmt.Appendf(nil, `{"type":"cdp","payload":%s}`, message)
+	}
+
+	plain := newClient(chrome.debugURL(), 0, WithCommandTimeout(100*time.Millisecond), WithMaxReconnectsPerRequest(0))
+	if err := plain.RefreshCookies(context.Background()); err == nil {
+		t.Error("matched enveloped responses by top-level id")
+	}
+	plain.Close()
+
+	c := newClient(chrome.debugURL(), 0, WithResponseMatcher(func(message []byte, id int64) ([]byte, bool) {
+		var envelope struct {
+			Payload json.RawMessage `json:"payload"`
+		}
+		var inner struct {
+			ID int64 `json:"id"`
+		}
+		if json.Unmarshal(message, &envelope) != nil || json.Unmarshal(envelope.Payload, &inner) != nil {
+			return nil, false
+		}
+		return envelope.Payload, inner.ID == id
+	}))
+	defer c.Close()
+	cookies, err := c.DefaultContextCookies(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cookies) != 1 || cookies[0].Value != "abc" {
+		t.Fatalf("cookies = %v, want sid=abc", cookies)
+	}
+}
+
+func TestSessionCookieTTL(t *testing.T) {
+	chrome := newFakeChrome(t, cookieHandlers(
+		&Cookie{Name: "session", Value: "1", Domain: "example.com", Path: "/", Session: true, Expires: -1},
+	))
+
+	c := newClient(chrome.debugURL(), time.Hour, WithSessionCookieTTL(50*time.Millisecond))
+	defer c.Close()
+	if err := c.RefreshCookies(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	u := &url.URL{Scheme: "http", Host: "example.com", Path: "/"}
+	if got := c.CookieHeader(u); got != "session=1" || c.needsRefresh() {
+		t.Fatalf("after refresh: cookies %q, refresh needed %v", got, c.needsRefresh())
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if got := c.CookieHeader(u); got != "" {
+		t.Errorf("session cookie still sent after its TTL: %q", got)
+	}
+	if !c.needsRefresh() {
+		t.Error("no refresh needed after the session cookie TTL")
+	}
+}
+
+func TestRefreshWithTimings(t *testing.T) {
+	handlers := cookieHandlers(&Cookie{Name: "sid", Value: "1", Domain: "example.com", Path: "/"})
+	getCookies := handlers["Storage.getCookies"]
+	handlers["Storage.getCookies"] = func(params json.RawMessage) (any, error) {
+		time.Sleep(10 * time.Millisecond)
+		return getCookies(params)
+	}
+	chrome := newFakeChrome(t, handlers)
+
+	c := newClient(chrome.debugURL(), 0)
+	defer c.Close()
+	timings, err := c.RefreshWithTimings(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if timings.Dial <= 0 || timings.Cookies < 10*time.Millisecond {
+		t.Errorf("first refresh timings %+v, want dial and cookie phases", timings)
+	}
+	if timings.Total < timings.Dial+timings.Cookies {
+		t.Errorf("total %v shorter than its phases %+v", timings.Total, timings)
+	}
+
+	timings, err = c.RefreshWithTimings(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if timings.Resolve != 0 || timings.Version != 0 || timings.Dial != 0 {
+		t.Errorf("reused connection reported connection phases: %+v", timings)
+	}
+	if timings.Cookies < 10*time.Millisecond {
+		t.Errorf("cookie phase %v, want at least 10ms", timings.Cookies)
+	}
+}
+
+func TestPartitionedCookies(t *testing.T) {
+	chrome := newFakeChrome(t, cookieHandlers(
+		&Cookie{Name: "plain", Value: "1", Domain: "widget.com", Path: "/"},
+		&Cookie{Name: "embedA", Value: "2", Domain: "widget.com", Path: "/",
+			PartitionKey: &CookiePartitionKey{TopLevelSite: "https://a.com"}},
+		&Cookie{Name: "embedB", Value: "3", Domain: "widget.com", Path: "/",
+			PartitionKey: &CookiePartitionKey{TopLevelSite: "https://b.com"}},
+	))
+
+	c := newClient(chrome.debugURL(), 0)
+	defer c.Close()
+	cookies, err := c.PartitionedCookies(context.Background(), "https://a.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cookies) != 1 || cookies[0].Name != "embedA" || !cookies[0].Partitioned {
+		t.Errorf("cookies for https://a.com = %v, want only embedA", cookies)
+	}
+
+	if cookies, err = c.PartitionedCookies(context.Background(), "https://c.com"); err != nil || len(cookies) != 0 {
+		t.Errorf("cookies for https://c.com = %v, %v, want none", cookies, err)
+	}
+}
+
+func TestMaxReconnectsPerRequest(t *testing.T) {
+	chrome := newFakeChrome(t, map[string]func(json.RawMessage) (any, error){
+		"Storage.getCookies": func(json.RawMessage) (any, error) {
+			return nil, errDropConnection
+		},
+	})
+
+	const delay = 20 * time.Millisecond
+	for _, tt := range []struct {
+		retries, reconnects int
+		dials               int64
+	}{
+		{retries: 5, reconnects: 0, dials: 1},
+		{retries: 5, reconnects: 1, dials: 2},
+		{retries: 5, reconnects: 3, dials: 4},
+		{retries: 2, reconnects: 5, dials: 3}, // reconnects share the retries
+	} {
+		var dials atomic.Int64
+		c := newClient(chrome.debugURL(), 0, WithConnectRetries(tt.retries), WithMaxReconnectsPerRequest(tt.reconnects),
+			WithBackoff(ExponentialBackoff{Base: delay, Max: delay}))
+		c.dialFunc = func(ctx context.Context, debugURL string) (*cdpClient, error) {
+			dials.Add(1)
+			return createCDPClient(ctx, debugURL)
+		}
+		start := time.Now()
+		if err := c.RefreshCookies(context.Background()); err == nil {
+			t.Errorf("%+v: refresh succeeded against a dropping Chrome", tt)
+		}
+		elapsed := time.Since(start)
+		c.Close()
+
+		if got := dials.Load(); got != tt.dials {
+			t.Errorf("%+v: dialed %d times, want %d", tt, got, tt.dials)
+		}
+		// The first reconnect is immediate, later ones wait for the backoff
+		waits := time.Duration(max(tt.dials-2, 0)) * delay
+		if elapsed < waits || elapsed > waits+time.Second {
+			t.Errorf("%+v: refresh took %v, want about %v", tt, elapsed, waits)
+		}
+	}
+}
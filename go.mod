@@ -1,5 +1,8 @@
 module github.com/xtdlib/cdphttp
 
-go 1.25
+go 1.25.0
 
-require github.com/coder/websocket v1.8.14
+require (
+	github.com/coder/websocket v1.8.14
+	golang.org/x/net v0.58.0
+)
@@ -2,15 +2,67 @@ package cdphttp
 
 import (
 	"context"
+	"errors"
 	"net/http"
 	"sync"
 	"time"
 )
 
 type roundTripper struct {
-	base      http.RoundTripper
-	client    *client
+	base   http.RoundTripper
+	client *client
+
+	// refreshMu guards inflight, the refresh concurrent requests wait on
 	refreshMu sync.Mutex
+	inflight  *refreshCall
+}
+
+// refreshCall is a refresh shared by all requests that need it
+type refreshCall struct {
+	done chan struct{}
+	err  error
+}
+
+// refresh refreshes the cookies, or waits for the refresh another request
+// already started. A refresh aborted by its starter's context is retried
+// rather than failing the waiting requests too.
+func (rt *roundTripper) refresh(ctx context.Context) error {
+	for {
+		rt.refreshMu.Lock()
+		call := rt.inflight
+		if call == nil {
+			if !rt.client.needsRefresh() {
+				rt.refreshMu.Unlock()
+				return nil
+			}
+			call = &refreshCall{done: make(chan struct{})}
+			rt.inflight = call
+			rt.refreshMu.Unlock()
+
+			call.err = rt.client.RefreshCookies(ctx)
+			rt.refreshMu.Lock()
+			rt.inflight = nil
+			rt.refreshMu.Unlock()
+			close(call.done)
+			return call.err
+		}
+		rt.refreshMu.Unlock()
+
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if call.err != nil && isContextError(call.err) && ctx.Err() == nil {
+			continue
+		}
+		return call.err
+	}
+}
+
+// isContextError reports whether err is due to a cancelled or expired context
+func isContextError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
 }
 
 func (rt *roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
@@ -19,39 +71,95 @@ func (rt *roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
 		ctx = context.Background()
 	}
 
+	if rt.client.closed.Load() {
+		return nil, ErrClosed
+	}
+
+	// A RoundTripper must not modify the caller's request, which may be sent
+	// again
+	req = req.Clone(ctx)
+
+	skip := req.Header.Get(SkipRefreshHeader) != "" || ctx.Value(skipRefreshKey{}) != nil
+	req.Header.Del(SkipRefreshHeader)
+
 	// Try to refresh cookies if cache is stale
-	rt.refreshMu.Lock()
-	if !rt.client.CacheValid() {
-		if err := rt.client.RefreshCookies(ctx); err != nil {
-			rt.refreshMu.Unlock()
+	if !skip && !rt.client.Paused() && rt.client.needsRefresh() {
+		if err := rt.refresh(ctx); err != nil {
 			return nil, err
 		}
 	}
-	rt.refreshMu.Unlock()
 
-	// Set user agent if available
-	if ua := rt.client.UserAgent(); ua != "" {
+	if report := rt.client.onCookieReport; report != nil {
+		report(rt.client.explainCookies(req.URL))
+	}
+
+	if rt.client.debugCookieHeader {
+		req.Header.Del("X-Debug-Cookies")
+		for _, h := range rt.client.debugCookieHeaders(req.URL) {
+			req.Header.Add("X-Debug-Cookies", h)
+		}
+	}
+
+	// Set user agent if available, keeping one set by the caller
+	if ua := rt.client.UserAgent(); ua != "" && req.Header.Get("User-Agent") == "" {
 		req.Header.Set("User-Agent", ua)
 	}
 
-	return rt.base.RoundTrip(req)
+	ae := rt.client.acceptEncoding
+	if ae == "" || req.Header.Get("Accept-Encoding") != "" || req.Method == http.MethodHead {
+		return rt.base.RoundTrip(req)
+	}
+
+	// Setting Accept-Encoding disables the transport's transparent gzip
+	// handling, so decode ourselves
+	req.Header.Set("Accept-Encoding", ae)
+	resp, err := rt.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	decodeBody(resp)
+	return resp, nil
+}
+
+// SkipRefreshHeader, set to any value on a request, sends it with the
+// cookies at hand without refreshing them first, e.g. for health checks that
+// must not depend on Chrome. The header is removed from the request sent,
+// leaving the caller's request untouched so retries are skipped too.
+const SkipRefreshHeader = "X-Cdphttp-Skip-Refresh"
+
+type skipRefreshKey struct{}
+
+// SkipRefresh returns a context for requests that are sent with the
+// cookies at hand without refreshing them first, like SkipRefreshHeader.
+func SkipRefresh(ctx context.Context) context.Context {
+	return context.WithValue(ctx, skipRefreshKey{}, true)
 }
 
 // NewClient creates an http.Client that injects Chrome cookies.
 // This function always succeeds - Chrome connection happens lazily on first request.
 // Errors are only returned from requests if Chrome is unavailable AND cache is expired.
-func NewClient(debugURL string) *http.Client {
-	return newClientWithOptions(debugURL, 5*time.Minute)
+func NewClient(debugURL string, opts ...Option) *http.Client {
+	return newClientWithOptions(debugURL, 5*time.Minute, opts...)
 }
 
 // newClientWithOptions creates an http.Client with custom cache TTL.
-func newClientWithOptions(debugURL string, cacheTTL time.Duration) *http.Client {
-	c := newClient(debugURL, cacheTTL)
+func newClientWithOptions(debugURL string, cacheTTL time.Duration, opts ...Option) *http.Client {
+	return newClient(debugURL, cacheTTL, opts...).httpClient(nil)
+}
 
+// httpClient wraps c in an http.Client sending requests through base, or
+// the transport set with WithBaseTransport if base is nil
+func (c *client) httpClient(base http.RoundTripper) *http.Client {
+	if base == nil {
+		base = c.baseTransport
+	}
+	if base == nil {
+		base = http.DefaultTransport
+	}
 	return &http.Client{
 		Jar: c.Jar,
 		Transport: &roundTripper{
-			base:   http.DefaultTransport,
+			base:   base,
 			client: c,
 		},
 	}
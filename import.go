@@ -0,0 +1,85 @@
+package cdphttp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// extensionCookie is a cookie as exported by browser extensions such as
+// EditThisCookie or Cookie-Editor, following chrome.cookies.Cookie.
+//
+// See: https://developer.chrome.com/docs/extensions/reference/api/cookies#type-Cookie
+type extensionCookie struct {
+	Name           string  `json:"name"`
+	Value          string  `json:"value"`
+	Domain         string  `json:"domain"`
+	Path           string  `json:"path"`
+	ExpirationDate float64 `json:"expirationDate"` // seconds since the UNIX epoch; absent for session cookies
+	HostOnly       bool    `json:"hostOnly"`
+	HTTPOnly       bool    `json:"httpOnly"`
+	Secure         bool    `json:"secure"`
+	Session        bool    `json:"session"`
+	SameSite       string  `json:"sameSite"` // "no_restriction", "lax", "strict" or "unspecified"
+}
+
+// extensionSameSite maps chrome.cookies.SameSiteStatus to the CDP value
+var extensionSameSite = map[string]string{
+	"no_restriction": "None",
+	"lax":            "Lax",
+	"strict":         "Strict",
+}
+
+// toCookie converts the exported cookie to the CDP shape, where domain
+// cookies have a leading dot and host-only cookies don't
+func (e *extensionCookie) toCookie() *Cookie {
+	domain := strings.TrimPrefix(e.Domain, ".")
+	if !e.HostOnly && domain != "" {
+		domain = "." + domain
+	}
+	cookie := &Cookie{
+		Name:     e.Name,
+		Value:    e.Value,
+		Domain:   domain,
+		Path:     e.Path,
+		HTTPOnly: e.HTTPOnly,
+		Secure:   e.Secure,
+		Session:  e.Session || e.ExpirationDate == 0,
+		SameSite: extensionSameSite[strings.ToLower(e.SameSite)],
+	}
+	if !cookie.Session {
+		cookie.Expires = e.ExpirationDate
+	}
+	return cookie
+}
+
+// ImportChromeExtensionJSON stores the cookies of a JSON export made with a
+// browser extension such as EditThisCookie, an array of chrome.cookies
+// objects, in the jar. Like WithInitialCookies, this treats the cache as
+// freshly refreshed, so requests can use the cookies without a live browser
+// until the cache TTL expires.
+func (c *client) ImportChromeExtensionJSON(r io.Reader) error {
+	var exported []*extensionCookie
+	if err := json.NewDecoder(r).Decode(&exported); err != nil {
+		return fmt.Errorf("failed to parse cookie export: %w", err)
+	}
+
+	c.jarMu.Lock()
+	defer c.jarMu.Unlock()
+	var stored []*Cookie
+	for _, e := range exported {
+		cookie := e.toCookie()
+		if c.excludedReason(cookie) == "" {
+			c.storeCookie(cookie)
+			stored = append(stored, cookie)
+		}
+	}
+
+	c.mu.Lock()
+	c.addImported(stored...)
+	c.lastRefresh = time.Now()
+	c.mu.Unlock()
+	return nil
+}
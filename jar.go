@@ -0,0 +1,185 @@
+package cdphttp
+
+import (
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// shardedJar is an http.CookieJar that keeps a separate cookiejar.Jar per
+// registrable domain, so that requests to different sites don't contend on
+// a single jar mutex.
+//
+// Without a public suffix list the shard key is approximated by the last
+// two labels of the host; hosts under multi-label suffixes such as co.uk
+// then share a shard, which is coarser but still correct.
+type shardedJar struct {
+	psl    cookiejar.PublicSuffixList
+	mu     sync.RWMutex
+	shards map[string]*cookiejar.Jar
+}
+
+func newShardedJar(psl cookiejar.PublicSuffixList) *shardedJar {
+	return &shardedJar{psl: psl, shards: make(map[string]*cookiejar.Jar)}
+}
+
+// SetCookies implements http.CookieJar
+func (j *shardedJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.shard(u.Hostname()).SetCookies(u, cookies)
+}
+
+// Cookies implements http.CookieJar
+func (j *shardedJar) Cookies(u *url.URL) []*http.Cookie {
+	j.mu.RLock()
+	jar := j.shards[registrableDomain(j.psl, u.Hostname())]
+	j.mu.RUnlock()
+
+	if jar == nil {
+		return nil
+	}
+	return jar.Cookies(u)
+}
+
+// shard returns the jar for host, creating it if needed
+func (j *shardedJar) shard(host string) *cookiejar.Jar {
+	key := registrableDomain(j.psl, host)
+
+	j.mu.RLock()
+	jar := j.shards[key]
+	j.mu.RUnlock()
+	if jar != nil {
+		return jar
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if jar := j.shards[key]; jar != nil {
+		return jar
+	}
+	jar, _ = cookiejar.New(&cookiejar.Options{PublicSuffixList: j.psl})
+	j.shards[key] = jar
+	return jar
+}
+
+// registrableDomain returns the registrable domain (eTLD+1) of host
+// according to psl. Without a list it is approximated by the last two
+// labels of host.
+func registrableDomain(psl cookiejar.PublicSuffixList, host string) string {
+	host = strings.ToLower(strings.Trim(host, "."))
+	if net.ParseIP(host) != nil {
+		return host
+	}
+
+	if psl != nil {
+		suffix := psl.PublicSuffix(host)
+		if suffix == host || !strings.HasSuffix(host, "."+suffix) {
+			return host
+		}
+		rest := host[:len(host)-len(suffix)-1]
+		return rest[strings.LastIndex(rest, ".")+1:] + "." + suffix
+	}
+
+	labels := strings.Split(host, ".")
+	if len(labels) <= 2 {
+		return host
+	}
+	return strings.Join(labels[len(labels)-2:], ".")
+}
+
+// singleLabelJar wraps a jar so that domain cookies of single-label domains
+// such as "intranet" also match their subdomains, e.g. "wiki.intranet".
+// cookiejar.Jar files such cookies under the single-label host itself (and
+// rejects them outright when the public suffix list treats the label as a
+// suffix), so they never reach subdomains.
+type singleLabelJar struct {
+	http.CookieJar
+
+	mu      sync.RWMutex
+	domains map[string]*cookiejar.Jar // domain cookies by single-label domain
+}
+
+func newSingleLabelJar(jar http.CookieJar) *singleLabelJar {
+	return &singleLabelJar{CookieJar: jar, domains: make(map[string]*cookiejar.Jar)}
+}
+
+// SetCookies implements http.CookieJar
+func (j *singleLabelJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.CookieJar.SetCookies(u, cookies)
+
+	host := strings.ToLower(strings.Trim(u.Hostname(), "."))
+	for _, cookie := range cookies {
+		domain := strings.ToLower(strings.Trim(cookie.Domain, "."))
+		if domain == "" || strings.Contains(domain, ".") || net.ParseIP(domain) != nil {
+			continue
+		}
+		if host != domain && !strings.HasSuffix(host, "."+domain) {
+			continue
+		}
+
+		j.mu.Lock()
+		jar := j.domains[domain]
+		if jar == nil {
+			jar, _ = cookiejar.New(nil)
+			j.domains[domain] = jar
+		}
+		j.mu.Unlock()
+		jar.SetCookies(&url.URL{Scheme: u.Scheme, Host: domain, Path: u.Path}, []*http.Cookie{cookie})
+	}
+}
+
+// Cookies implements http.CookieJar
+func (j *singleLabelJar) Cookies(u *url.URL) []*http.Cookie {
+	cookies := j.CookieJar.Cookies(u)
+
+	host := strings.ToLower(strings.Trim(u.Hostname(), "."))
+	i := strings.LastIndex(host, ".")
+	if i < 0 || net.ParseIP(host) != nil {
+		return cookies // the wrapped jar already matches the domain itself
+	}
+
+	j.mu.RLock()
+	jar := j.domains[host[i+1:]]
+	j.mu.RUnlock()
+	if jar == nil {
+		return cookies
+	}
+	return append(cookies, jar.Cookies(&url.URL{Scheme: u.Scheme, Host: host[i+1:], Path: u.Path})...)
+}
+
+// resettableJar is an http.CookieJar that can drop all its cookies at once,
+// e.g. for ClearCookies, while http.Clients keep referring to it
+type resettableJar struct {
+	newJar func() http.CookieJar
+
+	mu  sync.RWMutex
+	jar http.CookieJar
+}
+
+func newResettableJar(newJar func() http.CookieJar) *resettableJar {
+	return &resettableJar{newJar: newJar, jar: newJar()}
+}
+
+// SetCookies implements http.CookieJar
+func (j *resettableJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	j.jar.SetCookies(u, cookies)
+}
+
+// Cookies implements http.CookieJar
+func (j *resettableJar) Cookies(u *url.URL) []*http.Cookie {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	return j.jar.Cookies(u)
+}
+
+// reset replaces the jar with an empty one
+func (j *resettableJar) reset() {
+	jar := j.newJar()
+	j.mu.Lock()
+	j.jar = jar
+	j.mu.Unlock()
+}
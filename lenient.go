@@ -0,0 +1,97 @@
+package cdphttp
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+)
+
+// sanitizeNonFinite replaces the bare NaN, Infinity and -Infinity tokens
+// some Chromium forks emit, which are not valid JSON, with null. It returns
+// the sanitized data and the number of replacements.
+func sanitizeNonFinite(data []byte) ([]byte, int) {
+	if !bytes.Contains(data, []byte("NaN")) && !bytes.Contains(data, []byte("Infinity")) {
+		return data, 0
+	}
+
+	var out bytes.Buffer
+	out.Grow(len(data))
+	replaced := 0
+	inString, escaped := false, false
+	for i := 0; i < len(data); i++ {
+		b := data[i]
+		if inString {
+			switch {
+			case escaped:
+				escaped = false
+			case b == '\\':
+				escaped = true
+			case b == '"':
+				inString = false
+			}
+		} else if b == '"' {
+			inString = true
+		} else if token := nonFiniteToken(data[i:]); token != "" {
+			out.WriteString("null")
+			i += len(token) - 1
+			replaced++
+			continue
+		}
+		out.WriteByte(b)
+	}
+	return out.Bytes(), replaced
+}
+
+// nonFiniteToken returns the non-finite number token data starts with, if any
+func nonFiniteToken(data []byte) string {
+	for _, token := range []string{"-Infinity", "Infinity", "NaN"} {
+		if bytes.HasPrefix(data, []byte(token)) {
+			return token
+		}
+	}
+	return ""
+}
+
+// numericCookieFields are the cookie fields dropped by unmarshalCookieLenient
+// when they don't hold a number
+var numericCookieFields = []string{"expires", "size", "sourcePort"}
+
+// unmarshalCookiesLenient decodes a Storage.getCookies response, replacing
+// numeric fields that can't be parsed with their zero value and skipping
+// cookies that can't be decoded at all. Anomalies are logged to logger.
+func unmarshalCookiesLenient(data []byte, logger *slog.Logger) ([]*Cookie, error) {
+	var response struct {
+		Cookies []json.RawMessage `json:"cookies"`
+	}
+	if err := json.Unmarshal(data, &response); err != nil {
+		return nil, err
+	}
+
+	cookies := make([]*Cookie, 0, len(response.Cookies))
+	for _, raw := range response.Cookies {
+		var c Cookie
+		if err := json.Unmarshal(raw, &c); err == nil {
+			cookies = append(cookies, &c)
+			continue
+		}
+
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &fields); err != nil {
+			logger.Warn("skipping undecodable cookie", "err", err)
+			continue
+		}
+		for _, name := range numericCookieFields {
+			var f float64
+			if value, ok := fields[name]; ok && json.Unmarshal(value, &f) != nil {
+				logger.Warn("cookie has invalid field, using default", "cookie", string(fields["name"]), "field", name, "value", string(value))
+				delete(fields, name)
+			}
+		}
+		if err := json.Unmarshal(mustMarshal(fields), &c); err != nil {
+			logger.Warn("skipping undecodable cookie", "cookie", string(fields["name"]), "err", err)
+			continue
+		}
+		cookies = append(cookies, &c)
+	}
+	return cookies, nil
+}
@@ -0,0 +1,83 @@
+package cdphttp
+
+import (
+	"bufio"
+	"cmp"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+)
+
+// WriteNetscapeCookies writes the cookies from the most recent refresh,
+// plus seeded or imported ones, in the Netscape cookies.txt format read by
+// curl, wget and yt-dlp. HttpOnly cookies are prefixed with #HttpOnly_ like
+// curl does; session cookies have an expiry of 0. Cookies without a domain
+// get the host of WithDefaultCookieDomain, or are left out without it.
+func (c *client) WriteNetscapeCookies(w io.Writer) error {
+	c.jarMu.RLock()
+	c.mu.RLock()
+	all := c.jarCookies()
+	c.mu.RUnlock()
+	c.jarMu.RUnlock()
+
+	cookies := make([]*Cookie, 0, len(all))
+	for _, cookie := range all {
+		if cookie.Domain == "" {
+			u := c.cookieURL(cookie)
+			if u == nil {
+				continue
+			}
+			scoped := *cookie
+			scoped.Domain = u.Host
+			cookie = &scoped
+		}
+		cookies = append(cookies, cookie)
+	}
+
+	slices.SortFunc(cookies, func(a, b *Cookie) int {
+		return cmp.Or(
+			cmp.Compare(strings.TrimPrefix(a.Domain, "."), strings.TrimPrefix(b.Domain, ".")),
+			cmp.Compare(a.Path, b.Path),
+			cmp.Compare(a.Name, b.Name),
+		)
+	})
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprint(bw, "# Netscape HTTP Cookie File\n\n")
+	for _, cookie := range cookies {
+		fmt.Fprintln(bw, c.netscapeLine(cookie))
+	}
+	return bw.Flush()
+}
+
+// netscapeLine formats a cookie as a cookies.txt line: domain, whether
+// subdomains match, path, secure, expiry, name and value. The expiry is the
+// one the jar uses, i.e. limited by WithMaxExpiry.
+func (c *client) netscapeLine(cookie *Cookie) string {
+	// CDP marks domain cookies with a leading dot, as cookies.txt does
+	domain := cookie.Domain
+	if cookie.HTTPOnly {
+		domain = "#HttpOnly_" + domain
+	}
+	var expires int64
+	if !cookie.Session && cookie.Expires > 0 {
+		expires = c.toHTTPCookie(cookie).Expires.Unix()
+	}
+	return strings.Join([]string{
+		domain,
+		netscapeBool(strings.HasPrefix(cookie.Domain, ".")),
+		cookiePath(cookie.Path),
+		netscapeBool(cookie.Secure),
+		fmt.Sprint(expires),
+		cookie.Name,
+		cookie.Value,
+	}, "\t")
+}
+
+func netscapeBool(b bool) string {
+	if b {
+		return "TRUE"
+	}
+	return "FALSE"
+}
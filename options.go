@@ -0,0 +1,629 @@
+package cdphttp
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"time"
+
+	"github.com/coder/websocket"
+	"golang.org/x/net/proxy"
+)
+
+// Option configures a client created by NewClient.
+type Option func(*client)
+
+// WithName labels the client so that output from several clients can be
+// told apart. The name is included in recorder output.
+func WithName(name string) Option {
+	return func(c *client) {
+		c.name = name
+	}
+}
+
+// WithOnStale sets a callback invoked whenever Chrome is unavailable and
+// cached cookies are served instead. age is the time since the last
+// successful refresh.
+func WithOnStale(fn func(age time.Duration)) Option {
+	return func(c *client) {
+		c.onStale = fn
+	}
+}
+
+// WithRecorder writes every CDP command sent by the client to w as a JSON
+// line of the form {"method", "params", "result", "error", "latency"}, with
+// latency in nanoseconds. Cookie values, storage items and evaluated values
+// are redacted unless WithRecordCookieValues(true) is also given.
+func WithRecorder(w io.Writer) Option {
+	return func(c *client) {
+		if c.recorder == nil {
+			c.recorder = &recorder{}
+		}
+		c.recorder.w = w
+	}
+}
+
+// WithRecordCookieValues controls whether WithRecorder output includes
+// cookie values and other page data. It has no effect without WithRecorder.
+func WithRecordCookieValues(enabled bool) Option {
+	return func(c *client) {
+		if c.recorder == nil {
+			c.recorder = &recorder{}
+		}
+		c.recorder.recordCookieValues = enabled
+	}
+}
+
+// WithShardedJar stores cookies in one jar per registrable domain instead
+// of a single jar, so that concurrent requests to different sites don't
+// contend on the same lock. This helps crawlers talking to many domains at
+// the cost of a little memory per domain; for a handful of sites the single
+// default jar is just as fast.
+func WithShardedJar() Option {
+	return func(c *client) {
+		c.shardJar = true
+	}
+}
+
+// WithInitialCookies seeds the jar with cookies, e.g. saved from a previous
+// run, and treats them as freshly refreshed so the first request doesn't
+// wait for Chrome. Cookies from Chrome are merged on top once the cache TTL
+// expires. Cookies must have a Domain to be stored.
+func WithInitialCookies(cookies []*http.Cookie) Option {
+	return func(c *client) {
+		c.initialCookies = cookies
+	}
+}
+
+// WithWebSocketURL sets a known browser websocket URL such as
+// "ws://127.0.0.1:9222/devtools/browser/<id>". The client dials it directly
+// instead of querying /json/version on the debug URL, which allows the
+// HTTP debug endpoint and the websocket to live on different hosts.
+func WithWebSocketURL(wsURL string) Option {
+	return func(c *client) {
+		c.webSocketURL = wsURL
+		c.directWebSocket = false
+	}
+}
+
+// WithDirectWebSocketURL is like WithWebSocketURL, but dials wsURL exactly
+// as given: its host is not resolved to an IP address and no target is
+// looked up, e.g. to keep a container name Chrome is reachable by. wsURL
+// must use the ws or wss scheme.
+func WithDirectWebSocketURL(wsURL string) Option {
+	return func(c *client) {
+		c.webSocketURL = wsURL
+		c.directWebSocket = true
+	}
+}
+
+// WithCookieDebug calls fn for every request with a report of which cookies
+// from Chrome match the request URL and why the others were filtered out,
+// e.g. "3 cookies in jar, 0 matched host example.com path /; rejected ...".
+// Intended for debugging authentication failures.
+func WithCookieDebug(fn func(CookieReport)) Option {
+	return func(c *client) {
+		c.onCookieReport = fn
+	}
+}
+
+// WithOrigin sets the Origin header sent with the websocket handshake, as
+// required by Chrome launched with --remote-allow-origins. By default no
+// Origin header is sent.
+func WithOrigin(origin string) Option {
+	return func(c *client) {
+		c.dialOpts.origin = origin
+	}
+}
+
+// WithAuthHeader adds a header, e.g. Authorization, to the requests to the
+// /json endpoints and the websocket handshake, for debug endpoints behind
+// an authenticating proxy. The value is redacted from errors.
+func WithAuthHeader(key, value string) Option {
+	return func(c *client) {
+		if c.dialOpts.header == nil {
+			c.dialOpts.header = http.Header{}
+		}
+		c.dialOpts.header.Add(key, value)
+	}
+}
+
+// WithBackoff sets the strategy used to pace reconnect attempts. The
+// default is ExponentialBackoff from 100ms up to 5s.
+func WithBackoff(b Backoff) Option {
+	return func(c *client) {
+		if b != nil {
+			c.backoff = b
+		}
+	}
+}
+
+// WithMaxExpiry clamps the expiry of cookies stored in the jar or returned
+// by the client to at most now+max, protecting consumers from pathological
+// expiry dates such as year 9999.
+func WithMaxExpiry(max time.Duration) Option {
+	return func(c *client) {
+		c.maxExpiry = max
+	}
+}
+
+// WithMinExpectedCookies makes RefreshCookies fail with ErrTooFewCookies
+// when Chrome returns fewer than n cookies, catching a connection to the
+// wrong or an empty browser profile instead of sending unauthenticated
+// requests.
+func WithMinExpectedCookies(n int) Option {
+	return func(c *client) {
+		c.minCookies = n
+	}
+}
+
+// WithReconcileOnReconnect controls whether the first request after the
+// connection to Chrome is re-established refreshes cookies regardless of
+// the cache TTL, so that changes made while disconnected are picked up.
+// Enabled by default.
+func WithReconcileOnReconnect(enabled bool) Option {
+	return func(c *client) {
+		c.reconcileOnReconnect = enabled
+	}
+}
+
+// WithLenientJSON tolerates quirky CDP responses from Chromium forks: bare
+// NaN and Infinity numbers are read as null, and cookies with unparseable
+// numeric fields such as expires get default values instead of failing the
+// whole refresh. Anomalies are logged.
+func WithLenientJSON(enabled bool) Option {
+	return func(c *client) {
+		c.lenientJSON = enabled
+	}
+}
+
+// WithDevToolsActivePortFile connects to a Chrome launched with
+// --remote-debugging-port=0 by reading the port and browser path from the
+// DevToolsActivePort file in its user data dir, e.g.
+// "/tmp/chrome/DevToolsActivePort". The file is re-read on every connect.
+func WithDevToolsActivePortFile(path string) Option {
+	return func(c *client) {
+		c.activePortFile = path
+	}
+}
+
+// WithResponseMatcher sets how responses are matched to commands, for
+// proxies that wrap CDP messages in an envelope. This is an advanced
+// option; by default responses are matched by their top-level id.
+func WithResponseMatcher(match ResponseMatcher) Option {
+	return func(c *client) {
+		c.matchResponse = match
+	}
+}
+
+// WithOnUnmatchedResponse sets a callback invoked with every response no
+// command waits for, such as a late response to a command that timed out.
+// Such responses are dropped. fn runs on the connection's reader goroutine
+// and must not block.
+func WithOnUnmatchedResponse(fn func(id int64, message []byte)) Option {
+	return func(c *client) {
+		c.onUnmatchedResponse = fn
+	}
+}
+
+// WithDebugCookieHeader adds an X-Debug-Cookies header to outgoing requests
+// for every cookie from Chrome that matches the request, listing its
+// attributes but not its value. This is meant for inspecting traffic in
+// debugging proxies and is off by default.
+func WithDebugCookieHeader(enabled bool) Option {
+	return func(c *client) {
+		c.debugCookieHeader = enabled
+	}
+}
+
+// WithAdaptiveTimeout bounds cookie fetches by twice the 95th percentile of
+// recent fetch latencies, clamped to [min, max], instead of the fixed
+// command timeout. Until a fetch succeeded, max is used. Latencies are
+// kept across reconnects.
+func WithAdaptiveTimeout(min, max time.Duration) Option {
+	return func(c *client) {
+		c.adaptiveTimeout = &adaptiveTimeout{min: min, max: max}
+	}
+}
+
+// WithPublicSuffixList sets the public suffix list used by the cookie jar
+// and to determine registrable domains, typically publicsuffix.List from
+// golang.org/x/net/publicsuffix. CookiesByRegistrableDomain requires it.
+func WithPublicSuffixList(psl cookiejar.PublicSuffixList) Option {
+	return func(c *client) {
+		c.psl = psl
+	}
+}
+
+// WithAcceptEncoding sets the Accept-Encoding header of requests that don't
+// already have one, e.g. to ChromeAcceptEncoding so that traffic looks like
+// the browser's. gzip and deflate responses are still decompressed
+// transparently; bodies in other encodings such as br or zstd are returned
+// as is with their Content-Encoding header.
+func WithAcceptEncoding(value string) Option {
+	return func(c *client) {
+		c.acceptEncoding = value
+	}
+}
+
+// WithPreferTarget connects to the first page target listed by /json/list
+// instead of the browser endpoint from /json/version, falling back to the
+// browser endpoint when there is no page. Page connections see the cookies
+// of the page's browser context.
+func WithPreferTarget() Option {
+	return func(c *client) {
+		c.preferTarget = true
+	}
+}
+
+// WithPreferBrowser connects to the browser endpoint from /json/version.
+// This is the default.
+func WithPreferBrowser() Option {
+	return func(c *client) {
+		c.preferTarget = false
+	}
+}
+
+// WithSessionCookieTTL gives session cookies from Chrome a synthetic expiry
+// of d after each refresh, and forces a refresh once it has passed. Unlike
+// a browser, which keeps session cookies until it exits, this makes them
+// disappear if Chrome stops reporting them, e.g. to force re-authentication
+// after an idle period.
+func WithSessionCookieTTL(d time.Duration) Option {
+	return func(c *client) {
+		c.sessionCookieTTL = d
+	}
+}
+
+// WithSOCKS5 connects to Chrome through the SOCKS5 proxy at addr
+// ("host:port"), for both the /json/version fetch and the websocket. auth
+// may be nil if the proxy needs no credentials. The debug host is passed to
+// the proxy by name, like with WithForceIP(false), so that hosts only the
+// proxy can resolve are reachable.
+func WithSOCKS5(addr string, auth *proxy.Auth) Option {
+	return func(c *client) {
+		forward := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+		dialer, err := proxy.SOCKS5("tcp", addr, auth, forward)
+		if err != nil {
+			c.dialOpts.dialContext = func(context.Context, string, string) (net.Conn, error) {
+				return nil, fmt.Errorf("SOCKS5 proxy %s: %w", addr, err)
+			}
+			return
+		}
+		c.dialOpts.dialContext = dialer.(proxy.ContextDialer).DialContext
+		c.dialOpts.keepHost = true
+	}
+}
+
+// WithDialContext sets the function making the TCP connections to Chrome,
+// for both the /json endpoints and the websocket, e.g. to go through a
+// proxy or instrument connections. It replaces WithSOCKS5 and is ignored
+// if WithHTTPClient is used.
+func WithDialContext(dial func(ctx context.Context, network, addr string) (net.Conn, error)) Option {
+	return func(c *client) {
+		c.dialOpts.dialContext = dial
+	}
+}
+
+// WithDefaultCookieDomain sets a function returning the host that cookies
+// reported by Chrome without a domain are scoped to, e.g. the host of the
+// page being automated. Such cookies are stored as host-only cookies for
+// that host; without this option they are skipped since they can't be
+// scoped.
+func WithDefaultCookieDomain(fn func() string) Option {
+	return func(c *client) {
+		c.defaultCookieDomain = fn
+	}
+}
+
+// WithMaxReconnectsPerRequest caps how often a refresh reconnects to Chrome
+// after a failed cookie fetch before it gives up and serves the cache (or
+// returns ErrChromeUnavailable), bounding per-request latency during
+// outages. Reconnects after the first wait according to the backoff, and
+// each one uses up a retry of WithConnectRetries, so n above the connect
+// retries has no effect. Defaults to 1.
+func WithMaxReconnectsPerRequest(n int) Option {
+	return func(c *client) {
+		if n >= 0 {
+			c.maxReconnects = n
+		}
+	}
+}
+
+// WithCacheValidator replaces the cache TTL check deciding whether requests
+// need a refresh first. fn receives the time of the last refresh (zero if
+// none) and the cookies in the jar as of that refresh, like SnapshotCookies.
+// It runs without holding client locks, so it may use the client, except
+// for CacheValid and Stats, which call it.
+func WithCacheValidator(fn func(lastRefresh time.Time, cookies []*http.Cookie) bool) Option {
+	return func(c *client) {
+		c.cacheValidator = fn
+	}
+}
+
+// WithAllowSingleLabelDomains lets domain cookies of single-label domains
+// such as "intranet" match subdomains like "wiki.intranet", which the
+// public suffix rules otherwise prevent.
+//
+// This relaxes a security boundary: any host below a single-label domain
+// can then set cookies for all of its siblings, and since top-level domains
+// are single labels too, a cookie for e.g. "com" would be sent to every
+// .com site. Chrome itself refuses such cookies, but cookies from other
+// sources (WithInitialCookies) are trusted as is. Only enable this for
+// internal networks.
+func WithAllowSingleLabelDomains(allow bool) Option {
+	return func(c *client) {
+		c.allowSingleLabel = allow
+	}
+}
+
+// WithOnUserAgentChange re-reads the user agent from Chrome on every cookie
+// refresh and calls fn when it differs from the cached one, e.g. after a
+// browser upgrade. The cache is updated before fn is called.
+func WithOnUserAgentChange(fn func(old, new string)) Option {
+	return func(c *client) {
+		c.onUserAgentChange = fn
+	}
+}
+
+// WithCacheTTL sets how long cookies from Chrome are used before requests
+// refresh them. Defaults to 5 minutes.
+func WithCacheTTL(ttl time.Duration) Option {
+	return func(c *client) {
+		if ttl > 0 {
+			c.cacheTTL = ttl
+		}
+	}
+}
+
+// WithBaseTransport sets the transport requests are sent with after the
+// cookies and user agent are added, e.g. an instrumented one. Defaults to
+// http.DefaultTransport.
+func WithBaseTransport(rt http.RoundTripper) Option {
+	return func(c *client) {
+		c.baseTransport = rt
+	}
+}
+
+// WithUserAgentOverride sends ua as User-Agent instead of Chrome's user
+// agent.
+func WithUserAgentOverride(ua string) Option {
+	return func(c *client) {
+		c.userAgentOverride = ua
+	}
+}
+
+// WithUserAgentBuilder derives the user agent sent with requests from the
+// browser version information, e.g. to normalize the user agent of a
+// custom build from its Product and Revision. By default the user agent
+// Chrome reports is used as is.
+func WithUserAgentBuilder(fn func(BrowserVersion) string) Option {
+	return func(c *client) {
+		if fn != nil {
+			c.buildUserAgent = fn
+		}
+	}
+}
+
+// WithUserAgentRefresh re-fetches the user agent from Chrome on the first
+// refresh after interval has passed, so that a browser upgraded while the
+// client runs is picked up. The user agent is always re-fetched after
+// reconnecting. Zero, the default, only fetches it once per connection.
+func WithUserAgentRefresh(interval time.Duration) Option {
+	return func(c *client) {
+		c.userAgentRefresh = interval
+	}
+}
+
+// WithConnectRetries sets how often a refresh retries dialing Chrome before
+// it gives up and serves the cache (or returns ErrChromeUnavailable). The
+// retries are shared by failed dials and the reconnects allowed by
+// WithMaxReconnectsPerRequest, so a refresh dials at most n+1 times. Retries
+// are paced by the backoff, and consecutive failures are counted across
+// refreshes, so the delay keeps growing while Chrome is down and resets once
+// a connection succeeds. With the defaults, 2 retries and
+// ExponentialBackoff from 100ms up to 5s, a request waits at most 10s for
+// Chrome to come back.
+func WithConnectRetries(n int) Option {
+	return func(c *client) {
+		if n >= 0 {
+			c.connectRetries = n
+		}
+	}
+}
+
+// WithOnRefresh calls fn with the cookies fetched from Chrome and the time
+// of the refresh after every successful refresh, e.g. to persist them. fn
+// runs after the jar was updated, without holding any client locks, so it
+// may use the client.
+func WithOnRefresh(fn func(cookies []*http.Cookie, at time.Time)) Option {
+	return func(c *client) {
+		c.onRefresh = fn
+	}
+}
+
+// WithOnCookieChange calls fn with the cookies added, removed or changed
+// since the previous refresh after every refresh that changed any, e.g. to
+// log session rotation. Cookies are compared by name, domain and path; the
+// first refresh reports all cookies as added. Like WithOnRefresh, fn runs
+// without holding client locks.
+func WithOnCookieChange(fn func(CookieDelta)) Option {
+	return func(c *client) {
+		c.onCookieChange = fn
+	}
+}
+
+// WithTargetFilter connects to the first target listed by /json/list that
+// fn accepts instead of the browser endpoint, e.g. a specific tab to read
+// page-scoped state from. Connecting fails if no target matches.
+func WithTargetFilter(fn func(Target) bool) Option {
+	return func(c *client) {
+		c.targetFilter = fn
+	}
+}
+
+// WithCommandTimeout sets how long a single CDP command may take before it
+// fails. Zero bounds commands only by the deadline of the caller's context.
+// Defaults to 10s. Cookie fetches use the WithAdaptiveTimeout bounds
+// instead, if set.
+func WithCommandTimeout(d time.Duration) Option {
+	return func(c *client) {
+		if d >= 0 {
+			c.commandTimeout = d
+		}
+	}
+}
+
+// WithResolver resolves the debug host with r instead of
+// net.DefaultResolver, e.g. to use a cluster DNS server.
+func WithResolver(r *net.Resolver) Option {
+	return func(c *client) {
+		c.dialOpts.netResolver = r
+	}
+}
+
+// WithAddressFamily sets which address to connect to when the debug host
+// resolves to several, e.g. both IPv4 and IPv6 addresses. If there is no
+// address of the preferred family, the first address is used. Defaults to
+// PreferIPv4.
+func WithAddressFamily(family AddressFamily) Option {
+	return func(c *client) {
+		c.dialOpts.family = family
+	}
+}
+
+// WithHTTPClient sets the HTTP client used for the /json endpoints and the
+// websocket handshake, e.g. to go through an authenticating reverse proxy
+// or use custom TLS settings. It must not set a Timeout; requests are
+// bound by their context instead. By default a dedicated client without
+// proxy support is used.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *client) {
+		c.dialOpts.httpClient = hc
+	}
+}
+
+// WithTLSConfig sets the TLS configuration for wss:// debug URLs, e.g. to
+// trust the custom CA of a proxy terminating TLS in front of Chrome. The
+// /json endpoints of a wss:// debug URL are fetched over https. Ignored if
+// WithHTTPClient is used.
+func WithTLSConfig(config *tls.Config) Option {
+	return func(c *client) {
+		c.dialOpts.tlsConfig = config
+	}
+}
+
+// WithLogger logs connects, disconnects, reconnects and refreshes, and
+// anomalies in CDP messages, to logger. Refreshes are logged at debug
+// level, failures as warnings. Nothing is logged by default.
+func WithLogger(logger *slog.Logger) Option {
+	return func(c *client) {
+		if logger != nil {
+			c.logger = logger
+		}
+	}
+}
+
+// WithCookieFilter stores only the cookies for which keep returns true in
+// the jar, e.g. to send cookies of the target site only. Methods returning
+// cookies from Chrome, such as SnapshotCookies, are not filtered.
+func WithCookieFilter(keep func(*http.Cookie) bool) Option {
+	return func(c *client) {
+		c.cookieFilter = keep
+	}
+}
+
+// WithIncludePartitioned sets whether partitioned (CHIPS) cookies are
+// stored in the jar. The jar doesn't know partitions, so a partitioned
+// cookie may replace an unpartitioned one of the same name, domain and
+// path; excluding them keeps the unpartitioned cookie. Included by default.
+// RawCDPCookies and PartitionedCookies report partition keys either way.
+func WithIncludePartitioned(include bool) Option {
+	return func(c *client) {
+		c.includePartitioned = include
+	}
+}
+
+// WithVersionRetry retries fetching /json/version up to attempts more
+// times, pausing delay in between, if the connection fails or a proxy
+// answers 502, 503 or 504, e.g. while Chrome is still starting. Retries
+// stop at the deadline of the refresh. Not retried by default.
+func WithVersionRetry(attempts int, delay time.Duration) Option {
+	return func(c *client) {
+		c.dialOpts.versionRetries = attempts
+		c.dialOpts.versionRetryDelay = delay
+	}
+}
+
+// WithForceIP sets whether the host of the debug URL is resolved and
+// replaced by its IP address before connecting. Chrome only accepts
+// connections whose Host header is an IP address or localhost, so this is
+// on by default; turn it off for proxies that route by host name or to
+// keep a host name Chrome is reachable by, e.g. a container name. wss://
+// URLs always keep their host name.
+func WithForceIP(enabled bool) Option {
+	return func(c *client) {
+		c.dialOpts.keepHost = !enabled
+	}
+}
+
+// WithEndpoints sets several debug URLs, e.g. of redundant headless
+// browsers, replacing the one passed to NewClient. Connecting tries them in
+// order, starting with the one last connected to, so the client sticks to
+// a working endpoint and fails over to the next when it goes away. Stats
+// reports the endpoint in use.
+func WithEndpoints(debugURLs []string) Option {
+	return func(c *client) {
+		if len(debugURLs) > 0 {
+			c.endpoints = debugURLs
+			c.debugURL = debugURLs[0]
+		}
+	}
+}
+
+// WithReadLimit sets the maximum size in bytes of a message from Chrome,
+// such as the cookie list. The default of 10 MiB may be too small for
+// profiles with many thousands of cookies, or too large for constrained
+// devices. -1 removes the limit.
+func WithReadLimit(n int64) Option {
+	return func(c *client) {
+		if n > 0 || n == -1 {
+			c.dialOpts.readLimit = n
+		}
+	}
+}
+
+// WithCompression sets the permessage-deflate mode of the websocket, e.g.
+// websocket.CompressionContextTakeover to shrink large cookie lists over
+// slow links to a remote browser. Disabled by default to save CPU.
+func WithCompression(mode websocket.CompressionMode) Option {
+	return func(c *client) {
+		c.dialOpts.compression = mode
+	}
+}
+
+// WithCookiePollInterval sets how often WaitForCookie checks Chrome's
+// cookies. Defaults to 250ms.
+func WithCookiePollInterval(d time.Duration) Option {
+	return func(c *client) {
+		if d > 0 {
+			c.cookiePollInterval = d
+		}
+	}
+}
+
+// WithKeepalive pings Chrome every interval over the websocket to detect
+// connections that died silently, e.g. after the machine slept. A
+// connection whose ping goes unanswered for interval is closed, failing
+// pending commands right away, and replaced on the next refresh. Disabled
+// by default.
+func WithKeepalive(interval time.Duration) Option {
+	return func(c *client) {
+		c.keepaliveInterval = interval
+	}
+}
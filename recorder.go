@@ -0,0 +1,118 @@
+package cdphttp
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// recorder writes CDP command/response pairs to w as JSON lines
+type recorder struct {
+	mu                 sync.Mutex
+	w                  io.Writer
+	recordCookieValues bool
+	name               string
+}
+
+// recordEntry is a single recorded CDP command
+type recordEntry struct {
+	Name    string          `json:"name,omitempty"` // client name from WithName
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   string          `json:"error,omitempty"`
+	Latency time.Duration   `json:"latency"` // nanoseconds
+}
+
+// record writes one command/response pair. Recording errors are ignored so
+// that a broken writer never breaks the CDP connection.
+func (r *recorder) record(method string, params any, result json.RawMessage, err error, latency time.Duration) {
+	entry := recordEntry{
+		Name:    r.name,
+		Method:  method,
+		Result:  result,
+		Latency: latency,
+	}
+	if params != nil {
+		// Params that can't be encoded were never sent; err says why
+		entry.Params, _ = json.Marshal(params)
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	if !r.recordCookieValues {
+		entry.Params = redactCookieValues(method, entry.Params)
+		entry.Result = redactCookieValues(method, entry.Result)
+		if secretResults[method] && len(entry.Result) > 0 {
+			entry.Result = json.RawMessage(`"REDACTED"`)
+		}
+	}
+
+	line, jsonErr := json.Marshal(entry)
+	if jsonErr != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.w.Write(line)
+}
+
+// secretResults are methods whose entire result is page data, such as
+// storage items, IndexedDB records or evaluated values, and is redacted
+var secretResults = map[string]bool{
+	"DOMStorage.getDOMStorageItems": true,
+	"IndexedDB.requestData":         true,
+	"Runtime.evaluate":              true,
+	"Runtime.callFunctionOn":        true,
+}
+
+// redactCookieValues replaces the value of every object in a "cookies"
+// array with "REDACTED", as well as the top-level value of methods that
+// take a single cookie or storage item, e.g. Network.setCookie
+func redactCookieValues(method string, data json.RawMessage) json.RawMessage {
+	if len(data) == 0 {
+		return data
+	}
+	var v any
+	if err := json.Unmarshal(data, &v); err != nil {
+		return data
+	}
+	if obj, ok := v.(map[string]any); ok && (strings.Contains(method, "Cookie") || strings.HasPrefix(method, "DOMStorage.")) {
+		if _, ok := obj["value"]; ok {
+			obj["value"] = "REDACTED"
+		}
+	}
+	redacted, err := json.Marshal(redactValue(v))
+	if err != nil {
+		return data
+	}
+	return redacted
+}
+
+func redactValue(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for key, child := range v {
+			if cookies, ok := child.([]any); ok && key == "cookies" {
+				for _, c := range cookies {
+					if obj, ok := c.(map[string]any); ok {
+						if _, ok := obj["value"]; ok {
+							obj["value"] = "REDACTED"
+						}
+					}
+				}
+				continue
+			}
+			v[key] = redactValue(child)
+		}
+	case []any:
+		for i, child := range v {
+			v[i] = redactValue(child)
+		}
+	}
+	return v
+}
@@ -0,0 +1,35 @@
+package cdphttp
+
+import "time"
+
+// Stats describes the state of a client, e.g. for exporting metrics
+type Stats struct {
+	Connected    bool      // a connection to Chrome is open
+	Endpoint     string    // debug URL of the last connection, see WithEndpoints
+	LastRefresh  time.Time // zero if cookies were never refreshed
+	CacheValid   bool
+	LastError    error // most recent failure to connect or refresh, if any
+	RefreshCount int64 // successful refreshes
+}
+
+// Stats returns the current state of the client
+func (c *client) Stats() Stats {
+	c.mu.RLock()
+	s := Stats{
+		Connected:    c.cdpClient != nil && !c.cdpClient.dead.Load(),
+		Endpoint:     c.endpoint,
+		LastRefresh:  c.lastRefresh,
+		LastError:    c.lastError,
+		RefreshCount: c.refreshCount,
+	}
+	c.mu.RUnlock()
+	s.CacheValid = c.CacheValid()
+	return s
+}
+
+// recordError remembers err for Stats
+func (c *client) recordError(err error) {
+	c.mu.Lock()
+	c.lastError = err
+	c.mu.Unlock()
+}
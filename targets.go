@@ -0,0 +1,70 @@
+package cdphttp
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Target is a debugging target (page, service worker, ...) as listed by
+// the /json/list endpoint
+type Target struct {
+	ID                   string `json:"id"`
+	Type                 string `json:"type"`
+	Title                string `json:"title"`
+	URL                  string `json:"url"`
+	WebSocketDebuggerURL string `json:"webSocketDebuggerUrl"`
+}
+
+// ListTargets lists the debugging targets of the browser at debugURL via
+// its /json/list endpoint. Each target's WebSocketDebuggerURL connects to
+// that target; it is empty for targets another client is attached to.
+func ListTargets(ctx context.Context, debugURL string) ([]Target, error) {
+	return listTargets(ctx, &dialOptions{}, debugURL)
+}
+
+// listTargets fetches the targets of the browser at the debug URL. The
+// query is bound by the deadline of ctx, or 5 seconds if it has none.
+func listTargets(ctx context.Context, opts *dialOptions, urlstr string) ([]Target, error) {
+	lctx, cancel := ctx, context.CancelFunc(func() {})
+	if _, ok := ctx.Deadline(); !ok {
+		lctx, cancel = context.WithTimeout(ctx, 5*time.Second)
+	}
+	defer cancel()
+
+	u, err := jsonEndpoint(lctx, opts, urlstr, "/json/list")
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := opts.get(lctx, u)
+	if err != nil {
+		return nil, opts.redact(err)
+	}
+	defer resp.Body.Close()
+
+	var targets []Target
+	if err := decodeJSONResponse(resp, &targets); err != nil {
+		return nil, err
+	}
+	return targets, nil
+}
+
+// findTarget returns the websocket URL of the first target accepted by
+// filter, or of the first page if filter is nil
+func findTarget(ctx context.Context, opts *dialOptions, urlstr string, filter func(Target) bool) (string, error) {
+	targets, err := listTargets(ctx, opts, urlstr)
+	if err != nil {
+		return "", fmt.Errorf("failed to list targets: %w", err)
+	}
+
+	for _, t := range targets {
+		if t.WebSocketDebuggerURL == "" {
+			continue // already attached to another client
+		}
+		if (filter == nil && t.Type == "page") || (filter != nil && filter(t)) {
+			return forceIP(ctx, opts, t.WebSocketDebuggerURL)
+		}
+	}
+	return "", fmt.Errorf("no matching target")
+}
@@ -0,0 +1,55 @@
+package cdphttp
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// adaptiveTimeout derives the cookie fetch timeout from recently observed
+// fetch latencies: twice their 95th percentile, clamped to [min, max].
+type adaptiveTimeout struct {
+	min, max time.Duration
+
+	mu      sync.Mutex
+	samples []time.Duration // ring buffer of recent latencies
+	next    int
+}
+
+// adaptiveSamples is the number of latencies the timeout is derived from
+const adaptiveSamples = 50
+
+// timeout returns the timeout for the next fetch. Until a latency has been
+// observed it is max.
+func (a *adaptiveTimeout) timeout() time.Duration {
+	a.mu.Lock()
+	sorted := slices.Clone(a.samples)
+	a.mu.Unlock()
+
+	if len(sorted) == 0 {
+		return a.max
+	}
+	slices.Sort(sorted)
+	p95 := sorted[(len(sorted)*95-1)/100]
+	return min(max(2*p95, a.min), a.max)
+}
+
+// timedOut records a fetch that hit the timeout as taking max, so that the
+// timeout widens at once when Chrome slows down instead of every fetch
+// timing out at the old bound
+func (a *adaptiveTimeout) timedOut() {
+	a.observe(a.max)
+}
+
+// observe records the latency of a successful fetch
+func (a *adaptiveTimeout) observe(latency time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if len(a.samples) < adaptiveSamples {
+		a.samples = append(a.samples, latency)
+		return
+	}
+	a.samples[a.next] = latency
+	a.next = (a.next + 1) % adaptiveSamples
+}
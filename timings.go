@@ -0,0 +1,36 @@
+package cdphttp
+
+import (
+	"context"
+	"time"
+)
+
+// RefreshTimings breaks down how long the phases of a refresh took. The
+// connection phases are zero if an existing connection was reused.
+type RefreshTimings struct {
+	Resolve time.Duration // DNS resolution of the debug host
+	Version time.Duration // /json/version fetch
+	Dial    time.Duration // websocket handshake
+	Cookies time.Duration // Storage.getCookies round trip
+	Total   time.Duration
+}
+
+type timingsKey struct{}
+
+// recordTiming adds the time since start to the phase of the
+// RefreshTimings carried by ctx, if any
+func recordTiming(ctx context.Context, start time.Time, phase func(*RefreshTimings) *time.Duration) {
+	if t, ok := ctx.Value(timingsKey{}).(*RefreshTimings); ok {
+		*phase(t) += time.Since(start)
+	}
+}
+
+// RefreshWithTimings refreshes cookies like RefreshCookies and reports how
+// long each phase took, to tell slow DNS, network and Chrome apart.
+func (c *client) RefreshWithTimings(ctx context.Context) (RefreshTimings, error) {
+	var t RefreshTimings
+	start := time.Now()
+	err := c.RefreshCookies(context.WithValue(ctx, timingsKey{}, &t))
+	t.Total = time.Since(start)
+	return t, err
+}
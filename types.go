@@ -1,41 +1,213 @@
 package cdphttp
 
-import "errors"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
 
 // ErrChromeUnavailable is returned when Chrome is not available and cache is expired
 var ErrChromeUnavailable = errors.New("chrome unavailable and cache expired")
 
-// cookie cookie object.
+// ErrTooFewCookies is returned when Chrome reports fewer cookies than set
+// with WithMinExpectedCookies, which usually means the wrong browser profile
+var ErrTooFewCookies = errors.New("too few cookies")
+
+// ErrPaused is returned when refreshing cookies while the client is paused
+var ErrPaused = errors.New("client paused")
+
+// ErrNoPublicSuffixList is returned by CookiesByRegistrableDomain when no
+// list was set with WithPublicSuffixList
+var ErrNoPublicSuffixList = errors.New("no public suffix list")
+
+// ErrClosed is returned when using a client after Close, including by
+// refreshes that were in flight when it was closed
+var ErrClosed = errors.New("client closed")
+
+// ConnectError is returned when connecting to Chrome fails, e.g. because
+// the debug endpoint is unreachable or the websocket handshake failed.
+// Refreshes return it wrapped together with ErrChromeUnavailable.
+type ConnectError struct {
+	URL string // debug or websocket URL connected to
+	Err error
+}
+
+func (e *ConnectError) Error() string {
+	return fmt.Sprintf("failed to connect to %s: %v", e.URL, e.Err)
+}
+
+func (e *ConnectError) Unwrap() error {
+	return e.Err
+}
+
+// CDPError is an error response from Chrome to a CDP command, e.g. because
+// the method doesn't exist (code -32601) or its params are invalid.
+//
+// See: https://www.jsonrpc.org/specification#error_object
+type CDPError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Method  string `json:"-"` // method of the failed command
+}
+
+func (e *CDPError) Error() string {
+	return fmt.Sprintf("CDP error %d from %s: %s", e.Code, e.Method, e.Message)
+}
+
+// CookiesRejectedError is returned by SetCookies for cookies that cannot be
+// set in Chrome because no URL can be derived for them.
+type CookiesRejectedError struct {
+	Cookies []*http.Cookie
+}
+
+func (e *CookiesRejectedError) Error() string {
+	names := make([]string, 0, len(e.Cookies))
+	for _, c := range e.Cookies {
+		names = append(names, c.Name)
+	}
+	return fmt.Sprintf("cookies rejected (no domain): %s", strings.Join(names, ", "))
+}
+
+// Cookie is a cookie as reported by the Chrome DevTools Protocol, with every
+// field CDP provides. Use it where http.Cookie loses information, e.g. the
+// source scheme or partition key.
 //
 // See: https://chromedevtools.github.io/devtools-protocol/tot/Network#type-cookie
-type cookie struct {
-	Name     string  `json:"name"`     // Cookie name.
-	Value    string  `json:"value"`    // Cookie value.
-	Domain   string  `json:"domain"`   // Cookie domain.
-	Path     string  `json:"path"`     // Cookie path.
-	Expires  float64 `json:"expires"`  // Cookie expiration date as the number of seconds since the UNIX epoch.
-	Size     int64   `json:"size"`     // Cookie size.
-	HTTPOnly bool    `json:"httpOnly"` // True if cookie is http-only.
-	Secure   bool    `json:"secure"`   // True if cookie is secure.
-	Session  bool    `json:"session"`  // True in case of session cookie.
-	// SameSite           CookieSameSite      `json:"sameSite,omitempty,omitzero"`     // Cookie SameSite type.
-	// Priority           CookiePriority      `json:"priority"`                        // Cookie Priority
-	// SourceScheme       CookieSourceScheme  `json:"sourceScheme"`                    // Cookie source scheme type.
-	SourcePort int64 `json:"sourcePort"` // Cookie source port. Valid values are {-1, [1, 65535]}, -1 indicates an unspecified port. An unspecified port value allows protocol clients to emulate legacy cookie scope for the port. This is a temporary ability and it will be removed in the future.
-	// PartitionKey       *CookiePartitionKey `json:"partitionKey,omitempty,omitzero"` // Cookie partition key.
-	PartitionKeyOpaque bool `json:"partitionKeyOpaque"` // True if cookie partition key is opaque.
+type Cookie struct {
+	Name               string              `json:"name"`                   // Cookie name.
+	Value              string              `json:"value"`                  // Cookie value.
+	Domain             string              `json:"domain"`                 // Cookie domain.
+	Path               string              `json:"path"`                   // Cookie path.
+	Expires            float64             `json:"expires"`                // Cookie expiration date as the number of seconds since the UNIX epoch.
+	Size               int64               `json:"size"`                   // Cookie size.
+	HTTPOnly           bool                `json:"httpOnly"`               // True if cookie is http-only.
+	Secure             bool                `json:"secure"`                 // True if cookie is secure.
+	Session            bool                `json:"session"`                // True in case of session cookie.
+	SameSite           string              `json:"sameSite,omitempty"`     // Cookie SameSite type: "Strict", "Lax" or "None".
+	Priority           string              `json:"priority"`               // Cookie Priority: "Low", "Medium" or "High".
+	SourceScheme       string              `json:"sourceScheme"`           // Cookie source scheme type: "Unset", "NonSecure" or "Secure".
+	SourcePort         int64               `json:"sourcePort"`             // Cookie source port. Valid values are {-1, [1, 65535]}, -1 indicates an unspecified port. An unspecified port value allows protocol clients to emulate legacy cookie scope for the port. This is a temporary ability and it will be removed in the future.
+	PartitionKey       *CookiePartitionKey `json:"partitionKey,omitempty"` // Cookie partition key.
+	PartitionKeyOpaque bool                `json:"partitionKeyOpaque"`     // True if cookie partition key is opaque.
+}
+
+// CookiePartitionKey cookie partition key. The top-level site is the
+// top-most URL the cookie was set on, e.g. "https://example.com".
+//
+// See: https://chromedevtools.github.io/devtools-protocol/tot/Network#type-CookiePartitionKey
+type CookiePartitionKey struct {
+	TopLevelSite         string `json:"topLevelSite"`         // The site of the top-level URL the browser was visiting at the start of the request to the endpoint that set the cookie.
+	HasCrossSiteAncestor bool   `json:"hasCrossSiteAncestor"` // Indicates if the cookie has any ancestors that are cross-site to the topLevelSite.
+}
+
+// UnmarshalJSON also accepts the plain top-level site string older
+// protocol versions use as partition key
+func (k *CookiePartitionKey) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		k.HasCrossSiteAncestor = false
+		return json.Unmarshal(data, &k.TopLevelSite)
+	}
+	type plain CookiePartitionKey
+	return json.Unmarshal(data, (*plain)(k))
 }
 
 // getCookiesResponses is the response from Storage.getCookies
 type getCookiesResponses struct {
-	Cookies []*cookie `json:"cookies"`
+	Cookies []*Cookie `json:"cookies"`
+}
+
+// BrowserVersion is the browser version information returned by
+// Browser.getVersion.
+//
+// See: https://chromedevtools.github.io/devtools-protocol/tot/Browser#method-getVersion
+type BrowserVersion struct {
+	ProtocolVersion string `json:"protocolVersion"` // Protocol version.
+	Product         string `json:"product"`         // Product name, e.g. "Chrome/126.0.6478.126".
+	Revision        string `json:"revision"`        // Product revision.
+	UserAgent       string `json:"userAgent"`       // User-Agent.
+	JSVersion       string `json:"jsVersion"`       // V8 version.
+}
+
+// getBrowserContextsResponse is the response from Target.getBrowserContexts
+type getBrowserContextsResponse struct {
+	BrowserContextIDs []string `json:"browserContextIds"`
+}
+
+// getTargetInfoResponse is the response from Target.getTargetInfo
+type getTargetInfoResponse struct {
+	TargetInfo targetInfo `json:"targetInfo"`
+}
+
+// targetInfo describes a target.
+//
+// See: https://chromedevtools.github.io/devtools-protocol/tot/Target#type-TargetInfo
+type targetInfo struct {
+	TargetID string `json:"targetId"`
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	URL      string `json:"url"`
+}
+
+// navigateResponse is the response from Page.navigate
+type navigateResponse struct {
+	FrameID   string `json:"frameId"`
+	LoaderID  string `json:"loaderId"`  // Empty for same-document navigations.
+	ErrorText string `json:"errorText"` // User friendly error message, present if and only if navigation has failed.
+}
+
+// getDOMStorageItemsResponse is the response from
+// DOMStorage.getDOMStorageItems. Each entry is a key and value pair.
+type getDOMStorageItemsResponse struct {
+	Entries [][]string `json:"entries"`
+}
+
+// cookieParam cookie parameter object for Storage.setCookies.
+//
+// See: https://chromedevtools.github.io/devtools-protocol/tot/Network#type-CookieParam
+type cookieParam struct {
+	Name     string  `json:"name"`               // Cookie name.
+	Value    string  `json:"value"`              // Cookie value.
+	URL      string  `json:"url,omitempty"`      // The request-URI to associate with the setting of the cookie.
+	Domain   string  `json:"domain,omitempty"`   // Cookie domain.
+	Path     string  `json:"path,omitempty"`     // Cookie path.
+	Secure   bool    `json:"secure,omitempty"`   // True if cookie is secure.
+	HTTPOnly bool    `json:"httpOnly,omitempty"` // True if cookie is http-only.
+	Expires  float64 `json:"expires,omitempty"`  // Cookie expiration date, session cookie if not set.
+
+	PartitionKey *CookiePartitionKey `json:"partitionKey,omitempty"` // Cookie partition key, only sent to browsers that support it.
+}
+
+// remoteObject mirror object referencing original JavaScript object.
+//
+// See: https://chromedevtools.github.io/devtools-protocol/tot/Runtime#type-RemoteObject
+type remoteObject struct {
+	Type        string          `json:"type"`                  // Object type.
+	Value       json.RawMessage `json:"value,omitempty"`       // Remote object value in case of primitive values or JSON values (if it was requested).
+	Description string          `json:"description,omitempty"` // String representation of the object.
+}
+
+// evaluateResponse is the response from Runtime.evaluate
+type evaluateResponse struct {
+	Result           remoteObject      `json:"result"`
+	ExceptionDetails *exceptionDetails `json:"exceptionDetails,omitempty"`
+}
+
+// exceptionDetails describes an exception thrown during evaluation.
+//
+// See: https://chromedevtools.github.io/devtools-protocol/tot/Runtime#type-ExceptionDetails
+type exceptionDetails struct {
+	Text      string        `json:"text"`                // Exception text, e.g. "Uncaught".
+	Exception *remoteObject `json:"exception,omitempty"` // Exception object if available.
 }
 
-// getVersionResponse is the response from Browser.getVersion
-type getVersionResponse struct {
-	ProtocolVersion string `json:"protocolVersion"`
-	Product         string `json:"product"`
-	Revision        string `json:"revision"`
-	UserAgent       string `json:"userAgent"`
-	JSVersion       string `json:"jsVersion"`
+// requestDataResponse is the response from IndexedDB.requestData
+type requestDataResponse struct {
+	ObjectStoreDataEntries []struct {
+		Key        remoteObject `json:"key"`
+		PrimaryKey remoteObject `json:"primaryKey"`
+		Value      remoteObject `json:"value"`
+	} `json:"objectStoreDataEntries"`
+	HasMore bool `json:"hasMore"`
 }
@@ -0,0 +1,114 @@
+package cdphttp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ValidationReport is the result of Validate
+type ValidationReport struct {
+	Endpoint string
+	Checks   []ValidationCheck
+}
+
+// ValidationCheck is a single step of Validate
+type ValidationCheck struct {
+	Name     string
+	Duration time.Duration
+	Err      error
+}
+
+// OK reports whether all checks passed
+func (r ValidationReport) OK() bool {
+	for _, check := range r.Checks {
+		if check.Err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func (r ValidationReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "endpoint %s\n", r.Endpoint)
+	for _, check := range r.Checks {
+		status := "ok"
+		if check.Err != nil {
+			status = "FAILED: " + check.Err.Error()
+		}
+		fmt.Fprintf(&b, "%-16s %10s  %s\n", check.Name, check.Duration.Round(time.Microsecond), status)
+	}
+	return b.String()
+}
+
+// Validate diagnoses connectivity to Chrome over a separate connection,
+// without touching the client's connection, jar or cache. It resolves the
+// host, fetches /json/version, dials the websocket and issues
+// Browser.getVersion and Storage.getCookies, stopping at the first failure.
+// The returned error is that of the failed check.
+func (c *client) Validate(ctx context.Context) (ValidationReport, error) {
+	var report ValidationReport
+	check := func(name string, fn func() error) error {
+		start := time.Now()
+		err := fn()
+		report.Checks = append(report.Checks, ValidationCheck{Name: name, Duration: time.Since(start), Err: err})
+		return err
+	}
+
+	endpoint, err := c.endpointURL()
+	report.Endpoint = endpoint
+	if err != nil {
+		report.Checks = append(report.Checks, ValidationCheck{Name: "endpoint", Err: err})
+		return report, err
+	}
+
+	if err := check("resolve host", func() error {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return err
+		}
+		host, _, err := net.SplitHostPort(u.Host)
+		if err != nil {
+			return err
+		}
+		_, err = resolveHost(ctx, &c.dialOpts, host)
+		return err
+	}); err != nil {
+		return report, err
+	}
+
+	var wsURL string
+	if err := check("json/version", func() (err error) {
+		wsURL, err = getWebSocketURL(ctx, &c.dialOpts, endpoint)
+		return err
+	}); err != nil {
+		return report, err
+	}
+
+	var cdpClient *cdpClient
+	if err := check("dial websocket", func() (err error) {
+		cdpClient, err = dialWebSocket(ctx, wsURL, c.dialOpts)
+		return err
+	}); err != nil {
+		return report, err
+	}
+	defer cdpClient.Close()
+	c.configure(cdpClient)
+
+	if err := check("browser version", func() error {
+		_, err := cdpClient.fetchVersion(ctx)
+		return err
+	}); err != nil {
+		return report, err
+	}
+
+	err = check("get cookies", func() error {
+		_, err := cdpClient.fetchCookies(ctx)
+		return err
+	})
+	return report, err
+}